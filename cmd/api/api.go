@@ -1,11 +1,22 @@
 package api
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/config"
+	"github.com/izumii.cxde/blog-api/service/admin"
 	"github.com/izumii.cxde/blog-api/service/blog"
+	"github.com/izumii.cxde/blog-api/service/bookmark"
+	"github.com/izumii.cxde/blog-api/service/category"
+	"github.com/izumii.cxde/blog-api/service/comment"
+	"github.com/izumii.cxde/blog-api/service/feed"
+	"github.com/izumii.cxde/blog-api/service/reaction"
+	"github.com/izumii.cxde/blog-api/service/sitemap"
+	"github.com/izumii.cxde/blog-api/service/tag"
 	"github.com/izumii.cxde/blog-api/service/user"
 	"gorm.io/gorm"
 )
@@ -25,13 +36,73 @@ func (s *APIServer) Run() error {
 	subrouter := router.PathPrefix("/api/v1").Subrouter()
 
 	userStore := user.NewStore(s.db)
-	userHandler := user.NewHandler(userStore)
-	userHandler.RegisterRoutes(subrouter)
 
 	blogStore := blog.NewStore(s.db)
-	blogHandler := blog.NewHandler(blogStore, userStore)
+	if err := blogStore.BackfillSlugs(); err != nil {
+		return err
+	}
+	if err := blogStore.BackfillContentHTML(); err != nil {
+		return err
+	}
+	if err := blogStore.BackfillSearchVectors(); err != nil {
+		return err
+	}
+	reactionStore := reaction.NewStore(s.db)
+	blogHandler := blog.NewHandler(blogStore, userStore, reactionStore)
 	blogHandler.RegisterRoutes(subrouter)
 
+	userHandler := user.NewHandler(userStore)
+	userHandler.RegisterRoutes(subrouter, blogHandler.AuthMiddleware)
+
+	adminHandler := admin.NewHandler(userStore)
+	adminHandler.RegisterRoutes(subrouter, blogHandler.AuthMiddleware)
+
+	tagStore := tag.NewStore(s.db)
+	if err := tagStore.NormalizeExistingTags(); err != nil {
+		return err
+	}
+	tagHandler := tag.NewHandler(tagStore)
+	tagHandler.RegisterRoutes(subrouter, blogHandler.AuthMiddleware)
+
+	categoryStore := category.NewStore(s.db)
+	categoryHandler := category.NewHandler(categoryStore)
+	categoryHandler.RegisterRoutes(subrouter, blogHandler.AuthMiddleware)
+
+	commentStore := comment.NewStore(s.db)
+	commentHandler := comment.NewHandler(commentStore, blogStore, userStore)
+	commentHandler.RegisterRoutes(subrouter, blogHandler.AuthMiddleware, blogHandler.ViewerMiddleware)
+
+	reactionHandler := reaction.NewHandler(reactionStore, blogStore, commentStore)
+	reactionHandler.RegisterRoutes(subrouter, blogHandler.AuthMiddleware)
+
+	bookmarkStore := bookmark.NewStore(s.db)
+	bookmarkHandler := bookmark.NewHandler(bookmarkStore, blogStore)
+	bookmarkHandler.RegisterRoutes(subrouter, blogHandler.AuthMiddleware, blogHandler.ViewerMiddleware)
+
+	// feeds are served from the root, e.g. /feed.rss
+	feedHandler := feed.NewHandler(blogStore, userStore, categoryStore)
+	feedHandler.RegisterRoutes(router)
+
+	sitemapHandler := sitemap.NewHandler(sitemap.NewStore(s.db))
+	sitemapHandler.RegisterRoutes(router)
+	blogHandler.OnChange(sitemapHandler.Invalidate)
+
+	// publishes scheduled blogs in the background
+	publisher := blog.NewPublisher(blogStore, time.Second*time.Duration(config.Envs.PublishInterval))
+	publisher.OnPublish(sitemapHandler.Invalidate)
+	go publisher.Start(context.Background())
+
+	// empties the trash of blogs deleted more than TRASH_RETENTION_DAYS ago
+	if config.Envs.TrashRetentionDays > 0 {
+		retention := 24 * time.Hour * time.Duration(config.Envs.TrashRetentionDays)
+		go blog.NewPurger(blogStore, retention, time.Hour).Start(context.Background())
+	}
+
+	// deletes the accounts whose ACCOUNT_DELETION_GRACE_DAYS are over
+	deleter := user.NewDeleter(userStore, time.Hour)
+	deleter.OnDelete(sitemapHandler.Invalidate)
+	go deleter.Start(context.Background())
+
 	slog.Info("Listening on: ", slog.String("addr", s.addr))
 	return http.ListenAndServe(s.addr, router)
 }
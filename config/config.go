@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/joho/godotenv"
@@ -11,6 +12,8 @@ import (
 type Config struct {
 	PublicHost string `env:"PUBLIC_HOST"`
 	Port       string `env:"PORT"`
+	// the web app the links in emails open. its pages read the token from the link and post it to the api
+	FrontendURL string `env:"FRONTEND_URL"`
 
 	DBUser     string `env:"DB_USER"`
 	DBPassword string `env:"DB_PASSWORD"`
@@ -19,8 +22,50 @@ type Config struct {
 	DBAddress  string `env:"DATABASE_URL"`
 	DBName     string `env:"DB_NAME"`
 
-	JWTSecret     string `env:"JWT_SECRET"`
-	JWTExpiration int64  `env:"JWT_EXPIRATION"`
+	JWTSecret string `env:"JWT_SECRET"`
+	// lifetime in seconds of the access token, and of the refresh token used to renew it
+	JWTExpiration          int64 `env:"JWT_EXPIRATION" envDefault:"900"`
+	RefreshTokenExpiration int64 `env:"REFRESH_TOKEN_EXPIRATION" envDefault:"2592000"`
+
+	// users given the admin role on startup
+	AdminUserIds []int64 `env:"ADMIN_USER_IDS" envSeparator:","`
+
+	// how often (in seconds) the background publisher looks for scheduled blogs
+	PublishInterval int64 `env:"PUBLISH_INTERVAL" envDefault:"60"`
+
+	// days a soft deleted blog stays in the trash before it is deleted for good, 0 keeps them forever
+	TrashRetentionDays int64 `env:"TRASH_RETENTION_DAYS" envDefault:"30"`
+
+	// names of the enabled social login providers, each configured by its OAUTH_<NAME>_* variables
+	OAuthProviderNames []string                 `env:"OAUTH_PROVIDERS" envSeparator:","`
+	OAuthProviders     map[string]OAuthProvider `env:"-"`
+
+	// the name authenticator apps show next to the account
+	TOTPIssuer string `env:"TOTP_ISSUER" envDefault:"Go-Blog"`
+
+	// days between a user asking to delete their account and it being deleted, during which they can cancel
+	AccountDeletionGraceDays int64 `env:"ACCOUNT_DELETION_GRACE_DAYS" envDefault:"14"`
+
+	// paths crawlers are asked to skip, or a file served as robots.txt instead
+	RobotsDisallow []string `env:"ROBOTS_DISALLOW" envSeparator:","`
+	RobotsFile     string   `env:"ROBOTS_FILE"`
+}
+
+/*
+OAuthProvider configures a social login provider. OpenID Connect providers only need an issuer,
+the endpoints and signing keys are discovered from it. "google" defaults to Google's issuer,
+and "github" (which doesn't support OpenID Connect) uses the GitHub api
+*/
+type OAuthProvider struct {
+	Name         string
+	ClientID     string   `env:"CLIENT_ID"`
+	ClientSecret string   `env:"CLIENT_SECRET"`
+	Issuer       string   `env:"ISSUER"`
+	Scopes       []string `env:"SCOPES" envSeparator:","`
+	// only for github, e.g. for GitHub Enterprise
+	AuthURL  string `env:"AUTH_URL"`
+	TokenURL string `env:"TOKEN_URL"`
+	APIURL   string `env:"API_URL"`
 }
 
 var Envs = initConfig()
@@ -32,5 +77,21 @@ func initConfig() Config {
 		log.Fatal(fmt.Errorf("error loading the env variables: %w", err))
 		return Config{}
 	}
+
+	if envs.FrontendURL == "" {
+		envs.FrontendURL = envs.PublicHost
+	}
+	envs.FrontendURL = strings.TrimSuffix(envs.FrontendURL, "/")
+
+	envs.OAuthProviders = make(map[string]OAuthProvider, len(envs.OAuthProviderNames))
+	for _, name := range envs.OAuthProviderNames {
+		name = strings.ToLower(strings.TrimSpace(name))
+		p, err := env.ParseAsWithOptions[OAuthProvider](env.Options{Prefix: "OAUTH_" + strings.ToUpper(name) + "_"})
+		if err != nil {
+			log.Fatal(fmt.Errorf("error loading the %s oauth provider: %w", name, err))
+		}
+		p.Name = name
+		envs.OAuthProviders[name] = p
+	}
 	return envs
 }
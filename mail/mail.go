@@ -5,6 +5,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"time"
 
 	"gopkg.in/gomail.v2"
 )
@@ -15,6 +16,35 @@ import (
 if the verification code is sent successfully then return true, nil else return false, error message.
 */
 func SendMail(verificationCode string, to string, username string) error {
+	return send(to, "Verification code for aruka feedback", MailTemplate(verificationCode, username))
+}
+
+/*
+SendPasswordResetMail sends the link to reset the password of an account
+@params link string, to string, username string, expiresIn - how long the link stays valid
+*/
+func SendPasswordResetMail(link string, to string, username string, expiresIn time.Duration) error {
+	return send(to, "Reset your Nax blogs password", PasswordResetTemplate(link, username, expiresIn))
+}
+
+/*
+SendEmailChangeConfirmation sends the link confirming a new email address to that address
+@params link string, to string (the new address), username string, expiresIn - how long the link stays valid
+*/
+func SendEmailChangeConfirmation(link string, to string, username string, expiresIn time.Duration) error {
+	return send(to, "Confirm your new Nax blogs email", EmailChangeConfirmationTemplate(link, username, expiresIn))
+}
+
+/*
+SendEmailChangeNotice tells the old address that the email of the account is being changed
+@params undoLink string, to string (the old address), username string, newEmail string
+*/
+func SendEmailChangeNotice(undoLink string, to string, username string, newEmail string) error {
+	return send(to, "Your Nax blogs email is being changed", EmailChangeNoticeTemplate(undoLink, username, newEmail))
+}
+
+// send sends an html email through the configured smtp server
+func send(to, subject, body string) error {
 	_, err := regexp.MatchString(`^[a-zA-Z0-9._%+-]+@[a-z]+\.[a-zA-Z]{2,}$`, to)
 	if err != nil {
 		return fmt.Errorf("invalid email address")
@@ -27,8 +57,8 @@ func SendMail(verificationCode string, to string, username string) error {
 	m := gomail.NewMessage()
 	m.SetHeader("From", smtpUser)
 	m.SetHeader("To", to)
-	m.SetHeader("Subject", "Verification code for aruka feedback")
-	m.SetBody("text/html", MailTemplate(verificationCode, username))
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", body)
 
 	port, err := strconv.Atoi(smtpPort)
 	if err != nil {
@@ -1,6 +1,54 @@
 package mail
 
+import (
+	"fmt"
+	"html"
+	"time"
+)
+
 func MailTemplate(verificationCode string, username string) string {
+	return layout(`
+				<p style="font-size: 32px;">Hello ` + username + `,</p>
+				<p>You have requested a verification code for your Nax blogs account.</p>
+				<h2>Your verification code is: ` + verificationCode + `</h2>
+				<p>If you did not request this, please ignore this email.</p>
+				<p>Thank you for using Nax blogs.</p>`)
+}
+
+func PasswordResetTemplate(link string, username string, expiresIn time.Duration) string {
+	link = html.EscapeString(link)
+	return layout(`
+				<p style="font-size: 32px;">Hello ` + html.EscapeString(username) + `,</p>
+				<p>We received a request to reset the password of your Nax blogs account.</p>
+				<h2><a href="` + link + `">Choose a new password</a></h2>
+				<p>Or paste this link into your browser, it opens a page where you can choose your new password: ` + link + `</p>
+				<p>The link expires in ` + fmt.Sprintf("%.0f", expiresIn.Minutes()) + ` minutes and can only be used once.</p>
+				<p>If you did not request this, please ignore this email. Your password will not change.</p>`)
+}
+
+func EmailChangeConfirmationTemplate(link string, username string, expiresIn time.Duration) string {
+	link = html.EscapeString(link)
+	return layout(`
+				<p style="font-size: 32px;">Hello ` + html.EscapeString(username) + `,</p>
+				<p>Please confirm this is the new email address of your Nax blogs account.</p>
+				<h2><a href="` + link + `">Confirm your new email</a></h2>
+				<p>Or paste this link into your browser, it opens a page where you can confirm the change: ` + link + `</p>
+				<p>The link expires in ` + fmt.Sprintf("%.0f", expiresIn.Hours()) + ` hours. If you did not request this, please ignore this email.</p>`)
+}
+
+func EmailChangeNoticeTemplate(undoLink string, username string, newEmail string) string {
+	undoLink = html.EscapeString(undoLink)
+	return layout(`
+				<p style="font-size: 32px;">Hello ` + html.EscapeString(username) + `,</p>
+				<p>The email address of your Nax blogs account is being changed to ` + html.EscapeString(newEmail) + `.</p>
+				<p>If this was you, there is nothing to do.</p>
+				<h2><a href="` + undoLink + `">This wasn't me, undo the change</a></h2>
+				<p>The link opens a page where you can undo the change.</p>
+				<p>Undoing the change also logs your account out everywhere. Please reset your password afterwards.</p>`)
+}
+
+// layout wraps the content in the html shared by every email
+func layout(content string) string {
 	return `
 	<!DOCTYPE html>
 	<html>
@@ -42,12 +90,7 @@ func MailTemplate(verificationCode string, username string) string {
 		</head>
 		<body>
 			<div class="container">
-				<h1>Nax blogs | katana</h1>
-				<p style="font-size: 32px;">Hello ` + username + `,</p>
-				<p>You have requested a verification code for your Nax blogs account.</p>
-				<h2>Your verification code is: ` + verificationCode + `</h2>
-				<p>If you did not request this, please ignore this email.</p>
-				<p>Thank you for using Nax blogs.</p>
+				<h1>Nax blogs | katana</h1>` + content + `
 			</div>
 		</body>	
 	</html>
@@ -0,0 +1,54 @@
+package markdown
+
+import (
+	"bytes"
+	"regexp"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+)
+
+// md renders CommonMark with the GitHub flavoured extensions (tables, task lists, strikethrough, autolinks).
+// code blocks are highlighted with css classes instead of inline styles so the sanitiser can keep them
+var md = goldmark.New(
+	goldmark.WithExtensions(
+		extension.GFM,
+		highlighting.NewHighlighting(
+			highlighting.WithFormatOptions(chromahtml.WithClasses(true)),
+		),
+	),
+	goldmark.WithParserOptions(
+		parser.WithAutoHeadingID(), // heading anchors
+	),
+)
+
+// policy is the allow-list the rendered html is run through. raw html in the
+// markdown is dropped by goldmark already, this is the second line of defence
+var policy = newPolicy()
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	// syntax highlighting classes: language-go on code, chroma token classes on pre and span
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-zA-Z0-9\-_ ]+$`)).OnElements("pre", "code", "span")
+	// gfm task list checkboxes
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	return p
+}
+
+/*
+Render converts markdown to sanitised html
+@params: src(string) the markdown source
+@returns: the html, error
+*/
+func Render(src string) (string, error) {
+	var buf bytes.Buffer
+	if err := md.Convert([]byte(src), &buf); err != nil {
+		return "", err
+	}
+	return policy.Sanitize(buf.String()), nil
+}
@@ -0,0 +1,325 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/service/auth"
+	"github.com/izumii.cxde/blog-api/service/user"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+)
+
+type Handler struct {
+	userStore types.UserStore
+}
+
+func NewHandler(userStore types.UserStore) *Handler {
+	return &Handler{userStore: userStore}
+}
+
+/*
+RegisterRoutes registers the user management routes. every route needs the users permission (admins)
+@params: authMiddleware - authenticates the routes
+*/
+func (h *Handler) RegisterRoutes(router *mux.Router, authMiddleware mux.MiddlewareFunc) {
+	r := router.PathPrefix("/").Subrouter()
+	r.Handle("/admin/users", auth.Allow(types.PermissionManageUsers, h.handleSearchUsers)).Methods("GET")
+	r.Handle("/admin/users/{id:[0-9]+}", auth.Allow(types.PermissionManageUsers, h.handleGetUser)).Methods("GET")
+	r.Handle("/admin/users/{id:[0-9]+}/suspend", auth.Allow(types.PermissionManageUsers, h.handleSuspendUser(true))).Methods("POST")
+	r.Handle("/admin/users/{id:[0-9]+}/unsuspend", auth.Allow(types.PermissionManageUsers, h.handleSuspendUser(false))).Methods("POST")
+	r.Handle("/admin/users/{id:[0-9]+}/reverify", auth.Allow(types.PermissionManageUsers, h.handleRequireReverification)).Methods("POST")
+	r.Handle("/admin/users/{id:[0-9]+}/role", auth.Allow(types.PermissionManageUsers, h.handleChangeRole)).Methods("PUT")
+	r.Handle("/admin/users/{id:[0-9]+}/impersonate", auth.Allow(types.PermissionManageUsers, h.handleImpersonate)).Methods("POST")
+	r.Handle("/admin/roles", auth.Allow(types.PermissionManageUsers, h.handleGetRoles)).Methods("GET")
+	r.Handle("/admin/roles/{role}/two-factor", auth.Allow(types.PermissionManageUsers, h.handleRequireTwoFactor)).Methods("PUT")
+	r.Handle("/admin/audit-logs", auth.Allow(types.PermissionManageUsers, h.handleGetAuditLogs)).Methods("GET")
+
+	r.Use(authMiddleware)
+}
+
+// pagination reads ?limit= (max 100, default 20) and ?offset=
+func pagination(r *http.Request) (int, int) {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// targetUser parses the {id} of the route, refusing the admin's own account
+func targetUser(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user id: %w", err)
+	}
+	if id == r.Context().Value(types.UserIDKey).(int64) {
+		return 0, fmt.Errorf("you can't do this to your own account")
+	}
+	return id, nil
+}
+
+// audit records the action of the admin making the request
+func (h *Handler) audit(r *http.Request, action string, targetId int64, details string) error {
+	actorId := r.Context().Value(types.UserIDKey).(int64)
+	return h.userStore.CreateAuditLog(types.AuditLog{
+		ActorID:      uint(actorId),
+		Action:       action,
+		TargetUserID: uint(targetId),
+		Details:      details,
+	})
+}
+
+// handleSearchUsers lists users: ?q= (name or email) &role= &suspended=true|false &limit= &offset=
+func (h *Handler) handleSearchUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := types.UserSearchOptions{
+		Query: query.Get("q"),
+		Role:  types.Role(query.Get("role")),
+	}
+	opts.Limit, opts.Offset = pagination(r)
+	if opts.Role != "" && !opts.Role.Valid() {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid role: %s", opts.Role))
+		return
+	}
+	if s := query.Get("suspended"); s != "" {
+		suspended, err := strconv.ParseBool(s)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid suspended filter: %w", err))
+			return
+		}
+		opts.Suspended = &suspended
+	}
+
+	users, err := h.userStore.SearchUsers(opts)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting users: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, users)
+}
+
+func (h *Handler) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user id: %w", err))
+		return
+	}
+	u, err := h.userStore.GetUserById(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+// handleSuspendUser returns the handler that suspends or unsuspends a user. suspending takes a "reason"
+func (h *Handler) handleSuspendUser(suspend bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := targetUser(r)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		var p struct {
+			Reason string `json:"reason" validate:"max=500"`
+		}
+		if suspend {
+			if err := utils.ParseJSON(r, &p); err != nil {
+				utils.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := utils.Validate.Struct(p); err != nil {
+				utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+				return
+			}
+		}
+
+		if err := h.userStore.SetUserSuspended(id, suspend, p.Reason); err != nil {
+			utils.WriteError(w, http.StatusNotFound, fmt.Errorf("failed to update user: %w", err))
+			return
+		}
+		action, message := types.AuditActionUnsuspend, "user unsuspended"
+		if suspend {
+			action, message = types.AuditActionSuspend, "user suspended"
+		}
+		if err := h.audit(r, action, id, p.Reason); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to record audit log: %w", err))
+			return
+		}
+		utils.WriteJSON(w, http.StatusOK, map[string]string{"message": message})
+	}
+}
+
+// handleRequireReverification makes the user verify their email again
+func (h *Handler) handleRequireReverification(w http.ResponseWriter, r *http.Request) {
+	id, err := targetUser(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.userStore.RequireReverification(id); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("failed to update user: %w", err))
+		return
+	}
+	if err := h.audit(r, types.AuditActionReverify, id, ""); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to record audit log: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "user must verify their email again"})
+}
+
+// handleChangeRole sets the role of a user, {"role": "editor"}
+func (h *Handler) handleChangeRole(w http.ResponseWriter, r *http.Request) {
+	id, err := targetUser(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	var p struct {
+		Role types.Role `json:"role" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil || !p.Role.Valid() {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid role: %s", p.Role))
+		return
+	}
+
+	u, err := h.userStore.GetUserById(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	if err := h.userStore.SetUserRole(id, p.Role); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update user: %w", err))
+		return
+	}
+	if err := h.audit(r, types.AuditActionChangeRole, id, fmt.Sprintf("%s -> %s", u.Role, p.Role)); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to record audit log: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("user is now %s", p.Role)})
+}
+
+/*
+handleImpersonate logs the admin in as the user, replacing the admin's own token cookies.
+a "reason" is required and kept in the audit log, and the session is marked with the admin's id.
+other admins can't be impersonated
+*/
+func (h *Handler) handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	id, err := targetUser(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	var p struct {
+		Reason string `json:"reason" validate:"required,max=500"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+
+	u, err := h.userStore.GetUserById(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	if u.Can(types.PermissionManageUsers) {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("admins can't be impersonated"))
+		return
+	}
+	if u.SuspendedAt != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("suspended users can't be impersonated"))
+		return
+	}
+
+	// the audit log is written first, an impersonation must never go unrecorded
+	if err := h.audit(r, types.AuditActionImpersonate, id, p.Reason); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to record audit log: %w", err))
+		return
+	}
+	adminId := uint(r.Context().Value(types.UserIDKey).(int64))
+	if err := user.StartSession(w, r, h.userStore, *u, &adminId); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to impersonate user: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("you are now logged in as user %d", id)})
+}
+
+// handleGetAuditLogs lists the admin actions, newest first: ?user= (target user id) &limit= &offset=
+func (h *Handler) handleGetAuditLogs(w http.ResponseWriter, r *http.Request) {
+	var targetId int64
+	if u := r.URL.Query().Get("user"); u != "" {
+		id, err := strconv.ParseInt(u, 10, 64)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user id: %w", err))
+			return
+		}
+		targetId = id
+	}
+	limit, offset := pagination(r)
+	logs, err := h.userStore.GetAuditLogs(targetId, limit, offset)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting audit logs: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, logs)
+}
+
+// handleGetRoles lists the roles with their settings
+func (h *Handler) handleGetRoles(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.userStore.GetRoleSettings()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting roles: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, settings)
+}
+
+/*
+handleRequireTwoFactor makes two-factor authentication mandatory (or optional again) for a role.
+users of the role without 2FA are logged out and have to set it up on their next login
+*/
+func (h *Handler) handleRequireTwoFactor(w http.ResponseWriter, r *http.Request) {
+	role := types.Role(mux.Vars(r)["role"])
+	if !role.Valid() {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid role: %s", role))
+		return
+	}
+	var p struct {
+		Required *bool `json:"required" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+
+	if err := h.userStore.SetRoleRequiresTwoFactor(role, *p.Required); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update role: %w", err))
+		return
+	}
+	if err := h.audit(r, types.AuditActionRole2FA, 0, fmt.Sprintf("%s: %t", role, *p.Required)); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to record audit log: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("updated the %s role", role)})
+}
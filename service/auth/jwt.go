@@ -10,6 +10,15 @@ import (
 	"github.com/izumii.cxde/blog-api/types"
 )
 
+// Claims are the values carried by a token
+type Claims struct {
+	UserId int64
+	// the user's TokenVersion when the token was issued. tokens from older versions are revoked
+	TokenVersion int64
+	// the refresh token family (one per login) the token was issued for
+	FamilyId string
+}
+
 func ParseJWTRequest(r *http.Request) (int64, error) {
 	c, err := r.Cookie("token")
 	if err != nil {
@@ -18,15 +27,27 @@ func ParseJWTRequest(r *http.Request) (int64, error) {
 	return ValidateJWTToken(c.Value)
 }
 
+// ParseJWTRequestClaims is ParseJWTRequest, returning all the claims of the token
+func ParseJWTRequestClaims(r *http.Request) (*Claims, error) {
+	c, err := r.Cookie("token")
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWTClaims(c.Value)
+}
+
 /*
-GenerateJWTToken generates a JWT token
-@params: u(types.User) user info to generate the token
+GenerateJWTToken generates a short lived access token, it expires after JWT_EXPIRATION seconds
+@params: u(types.User) user info to generate the token, familyId - the refresh token family of the login
 */
-func GenerateJWTToken(u types.User) (string, error) {
-	expiration := time.Second * time.Duration(config.Envs.JWTExpiration)
+func GenerateJWTToken(u types.User, familyId string) (string, error) {
+	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":        u.ID,
-		"expiredAt": expiration,
+		"id":  u.ID,
+		"ver": u.TokenVersion,
+		"fid": familyId,
+		"iat": now.Unix(),
+		"exp": now.Add(AccessTokenTTL()).Unix(),
 	})
 	t, err := token.SignedString([]byte(config.Envs.JWTSecret))
 	if err != nil {
@@ -35,11 +56,33 @@ func GenerateJWTToken(u types.User) (string, error) {
 	return t, nil
 }
 
+// AccessTokenTTL is how long an access token is valid
+func AccessTokenTTL() time.Duration {
+	return time.Second * time.Duration(config.Envs.JWTExpiration)
+}
+
+// RefreshTokenTTL is how long a refresh token is valid. every refresh starts a new one
+func RefreshTokenTTL() time.Duration {
+	return time.Second * time.Duration(config.Envs.RefreshTokenExpiration)
+}
+
 /*
 validate the token from the request.
 @params: token(string) the token from the request
 */
 func ValidateJWTToken(token string) (int64, error) {
+	claims, err := ParseJWTClaims(token)
+	if err != nil {
+		return 0, err
+	}
+	return claims.UserId, nil
+}
+
+/*
+ParseJWTClaims validates the token and returns its claims
+@params: token(string) the token from the request
+*/
+func ParseJWTClaims(token string) (*Claims, error) {
 	// Parse the token and provide the signing key for verification
 	t, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
 		// Ensure the token is signed with the expected method (HS256 in this case)
@@ -47,25 +90,26 @@ func ValidateJWTToken(token string) (int64, error) {
 			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
 		}
 		return []byte(config.Envs.JWTSecret), nil
-	})
+	}, jwt.WithExpirationRequired())
 
 	if err != nil {
-		return 0, fmt.Errorf("error parsing token: %v", err)
+		return nil, fmt.Errorf("error parsing token: %v", err)
 	}
 
 	// Ensure the claims are valid and of the expected type
 	claims, ok := t.Claims.(jwt.MapClaims)
 	if !ok || !t.Valid {
-		return 0, fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
 	}
 
 	// Extract user ID from the claims
 	userIdFloat, ok := claims["id"].(float64)
 	if !ok {
-		return 0, fmt.Errorf("invalid or missing value in token")
+		return nil, fmt.Errorf("invalid or missing value in token")
 	}
+	version, _ := claims["ver"].(float64)
+	familyId, _ := claims["fid"].(string)
 
-	// Convert the float64 userId to int64
-	userId := int64(userIdFloat)
-	return userId, nil
+	// Convert the float64 values to int64
+	return &Claims{UserId: int64(userIdFloat), TokenVersion: int64(version), FamilyId: familyId}, nil
 }
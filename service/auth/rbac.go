@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/types"
+)
+
+/*
+RequirePermission only lets users whose role has the permission through. it must run after
+the auth middleware, which puts the role of the user in the request context
+@params: p - the permission the route needs
+*/
+func RequirePermission(p types.Permission) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !RoleFromRequest(r).Can(p) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Allow wraps a single route handler with RequirePermission, so the check reads next to the route
+func Allow(p types.Permission, next http.HandlerFunc) http.Handler {
+	return RequirePermission(p)(next)
+}
+
+// RoleFromRequest returns the role of the authenticated user, or "" when there is none
+func RoleFromRequest(r *http.Request) types.Role {
+	role, _ := r.Context().Value(types.UserRoleKey).(types.Role)
+	return role
+}
+
+// BlogEditor returns the authenticated user as the editor of a blog
+func BlogEditor(r *http.Request) types.BlogEditor {
+	userId, _ := r.Context().Value(types.UserIDKey).(int64)
+	return types.BlogEditor{
+		UserId:  userId,
+		AnyBlog: RoleFromRequest(r).Can(types.PermissionEditAnyPost),
+	}
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/izumii.cxde/blog-api/config"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/pquerna/otp/totp"
+)
+
+// the period of a TOTP code, and how many periods before and after now a code is still accepted
+const (
+	totpPeriod = 30
+	totpSkew   = 1
+)
+
+// NewTOTPSetup generates a TOTP secret for the account, with the otpauth uri and its QR code
+func NewTOTPSetup(accountName string) (*types.TwoFactorSetup, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      config.Envs.TOTPIssuer,
+		AccountName: accountName,
+		Period:      totpPeriod,
+	})
+	if err != nil {
+		return nil, err
+	}
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return &types.TwoFactorSetup{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+/*
+ValidateTOTP checks a code against the secret, allowing for a little clock drift
+@returns: the time step the code belongs to, so it can be refused when used again, and whether it is valid
+*/
+func ValidateTOTP(secret, code string) (int64, bool) {
+	now := time.Now()
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCode(secret, t)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return t.Unix() / totpPeriod, true
+		}
+	}
+	return 0, false
+}
+
+// letters and digits that can't be mistaken for each other when typed from paper
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+/*
+GenerateRecoveryCodes returns n random recovery codes like "abcd-efgh-jkmn", and their hashes for storage
+*/
+func GenerateRecoveryCodes(n int) ([]string, []string, error) {
+	codes := make([]string, 0, n)
+	hashes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		var sb strings.Builder
+		for j, c := range b {
+			if j > 0 && j%4 == 0 {
+				sb.WriteByte('-')
+			}
+			// 256 isn't a multiple of the alphabet, the slight bias is fine for 12 characters
+			sb.WriteByte(recoveryCodeAlphabet[int(c)%len(recoveryCodeAlphabet)])
+		}
+		codes = append(codes, sb.String())
+		hashes = append(hashes, HashRecoveryCode(sb.String()))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes a recovery code as typed by the user, ignoring case, spaces and dashes
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return HashToken(code)
+}
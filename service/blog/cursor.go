@@ -0,0 +1,74 @@
+package blog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/izumii.cxde/blog-api/types"
+)
+
+// cursor is the position after the last blog of a page. it is handed to
+// clients base64 encoded, so they treat it as opaque
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"` // the sort key of the last blog
+	ID    uint   `json:"id"`
+}
+
+// sortColumns maps every sort order to its column and whether it is descending
+var sortColumns = map[string]struct {
+	column string
+	desc   bool
+}{
+	types.BlogSortNewest:  {"created_at", true},
+	types.BlogSortOldest:  {"created_at", false},
+	types.BlogSortUpdated: {"updated_at", true},
+	types.BlogSortTitle:   {"title", false},
+	// blogs published before published_at was recorded fall back to their creation time
+	types.BlogSortPublished: {"COALESCE(published_at, created_at)", true},
+}
+
+func encodeCursor(sort string, b types.Blog) string {
+	c := cursor{Sort: sort, ID: b.ID}
+	switch sort {
+	case types.BlogSortTitle:
+		c.Value = b.Title
+	case types.BlogSortUpdated:
+		c.Value = b.UpdatedAt.Format(time.RFC3339Nano)
+	case types.BlogSortPublished:
+		published := b.CreatedAt
+		if b.PublishedAt != nil {
+			published = *b.PublishedAt
+		}
+		c.Value = published.Format(time.RFC3339Nano)
+	default:
+		c.Value = b.CreatedAt.Format(time.RFC3339Nano)
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor and returns the sort key value it points at
+func decodeCursor(s, sort string) (*cursor, any, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cursor")
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, nil, fmt.Errorf("invalid cursor")
+	}
+	if c.Sort != sort {
+		return nil, nil, fmt.Errorf("cursor does not match the sort order")
+	}
+	if sort == types.BlogSortTitle {
+		return &c, c.Value, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, c.Value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, t, nil
+}
@@ -0,0 +1,86 @@
+package blog
+
+import (
+	"strings"
+
+	"github.com/izumii.cxde/blog-api/types"
+)
+
+/*
+DiffRevisions returns a line-level diff of every field that differs between two revisions
+@params: from, to - the revisions to compare
+*/
+func DiffRevisions(from, to types.BlogRevision) types.RevisionDiff {
+	fields := map[string][2]string{
+		"title":       {from.Title, to.Title},
+		"description": {from.Description, to.Description},
+		"content":     {from.Content, to.Content},
+		"category":    {from.Category, to.Category},
+		// one tag per line, so added and removed tags show up as lines
+		"tags": {strings.Join(from.Tags, "\n"), strings.Join(to.Tags, "\n")},
+	}
+
+	diff := types.RevisionDiff{From: from, To: to, Fields: map[string][]types.DiffLine{}}
+	for name, f := range fields {
+		if f[0] == f[1] {
+			continue
+		}
+		diff.Fields[name] = DiffLines(f[0], f[1])
+	}
+	return diff
+}
+
+/*
+DiffLines computes a line-level diff between a and b using the longest common subsequence of their lines
+@params: a(string) the old text, b(string) the new text
+*/
+func DiffLines(a, b string) []types.DiffLine {
+	x := splitLines(a)
+	y := splitLines(b)
+
+	// lcs[i][j] holds the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []types.DiffLine
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			lines = append(lines, types.DiffLine{Op: "=", Text: x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, types.DiffLine{Op: "-", Text: x[i]})
+			i++
+		default:
+			lines = append(lines, types.DiffLine{Op: "+", Text: y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		lines = append(lines, types.DiffLine{Op: "-", Text: x[i]})
+	}
+	for ; j < len(y); j++ {
+		lines = append(lines, types.DiffLine{Op: "+", Text: y[j]})
+	}
+	return lines
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+}
@@ -0,0 +1,57 @@
+package blog
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/izumii.cxde/blog-api/types"
+)
+
+// Publisher periodically publishes drafts whose scheduled publish time has passed.
+type Publisher struct {
+	store     types.BlogStore
+	interval  time.Duration
+	onPublish []func()
+}
+
+func NewPublisher(store types.BlogStore, interval time.Duration) *Publisher {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &Publisher{store: store, interval: interval}
+}
+
+// OnPublish registers fn to be called after a run that published at least one blog
+func (p *Publisher) OnPublish(fn func()) {
+	p.onPublish = append(p.onPublish, fn)
+}
+
+// Start runs the publisher until the context is cancelled. It is meant to be run in its own goroutine
+func (p *Publisher) Start(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.publish()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Publisher) publish() {
+	n, err := p.store.PublishDueBlogs(time.Now())
+	if err != nil {
+		slog.Error("failed to publish scheduled blogs: ", slog.String("error", err.Error()))
+		return
+	}
+	if n > 0 {
+		slog.Info("published scheduled blogs", slog.Int64("count", n))
+		for _, fn := range p.onPublish {
+			fn()
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package blog
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/izumii.cxde/blog-api/types"
+)
+
+// Purger periodically hard deletes blogs that have been in the trash longer than the retention period.
+type Purger struct {
+	store     types.BlogStore
+	retention time.Duration
+	interval  time.Duration
+}
+
+func NewPurger(store types.BlogStore, retention, interval time.Duration) *Purger {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	return &Purger{store: store, retention: retention, interval: interval}
+}
+
+// Start runs the purger until the context is cancelled. It is meant to be run in its own goroutine
+func (p *Purger) Start(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.purge()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Purger) purge() {
+	n, err := p.store.PurgeDeletedBlogs(time.Now().Add(-p.retention))
+	if err != nil {
+		slog.Error("failed to purge deleted blogs: ", slog.String("error", err.Error()))
+		return
+	}
+	if n > 0 {
+		slog.Info("purged deleted blogs", slog.Int64("count", n))
+	}
+}
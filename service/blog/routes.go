@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
@@ -15,54 +16,281 @@ import (
 )
 
 type Handler struct {
-	store     types.BlogStore
-	userStore types.UserStore
+	store         types.BlogStore
+	userStore     types.UserStore
+	reactionStore types.ReactionStore
+	onChange      []func()
 }
 
-func NewHandler(store types.BlogStore, userStore types.UserStore) *Handler {
-	return &Handler{store: store, userStore: userStore}
+func NewHandler(store types.BlogStore, userStore types.UserStore, reactionStore types.ReactionStore) *Handler {
+	return &Handler{store: store, userStore: userStore, reactionStore: reactionStore}
+}
+
+// OnChange registers fn to be called after a blog is created, updated or deleted
+func (h *Handler) OnChange(fn func()) {
+	h.onChange = append(h.onChange, fn)
+}
+
+func (h *Handler) changed() {
+	for _, fn := range h.onChange {
+		fn()
+	}
 }
 
 // validate if the user is authorized to visit these routes.
 func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userId, err := auth.ParseJWTRequest(r)
-		if err != nil || userId == 0 {
+		u, session, err := h.authenticate(r)
+		if err != nil || u.ID == 0 {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
 		// if the user is authenticated then send the user id from the token to the actual handler
-		ctx := context.WithValue(r.Context(), types.UserIDKey, userId)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, withUser(r, u, session))
+	})
+}
+
+// ViewerMiddleware identifies the user on public routes. requests without a valid token
+// go through anonymously, so revoked and suspended tokens only lose what a login would show
+func (h *Handler) ViewerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, session, err := h.authenticate(r); err == nil && u.ID != 0 {
+			r = withUser(r, u, session)
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
+// withUser puts the id, session and role of the authenticated user in the request context
+func withUser(r *http.Request, u *types.User, session *types.Session) *http.Request {
+	ctx := context.WithValue(r.Context(), types.UserIDKey, int64(u.ID))
+	ctx = context.WithValue(ctx, types.SessionIDKey, session.ID)
+	ctx = context.WithValue(ctx, types.UserRoleKey, u.Role)
+	return r.WithContext(ctx)
+}
+
+// viewerId returns the id of the user making the request, or 0 for anonymous requests.
+// This is used on public routes where being logged in only changes what is visible,
+// the user is put in the context by ViewerMiddleware there
+func (h *Handler) viewerId(r *http.Request) int64 {
+	userId, _ := r.Context().Value(types.UserIDKey).(int64)
+	return userId
+}
+
+// how often the last seen time of a session is written, rather than on every request
+const sessionTouchInterval = time.Minute
+
+/*
+authenticate returns the user and the session of the request's token. tokens of revoked sessions,
+tokens issued before the user logged out everywhere and tokens of suspended users are rejected
+*/
+func (h *Handler) authenticate(r *http.Request) (*types.User, *types.Session, error) {
+	claims, err := auth.ParseJWTRequestClaims(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := h.userStore.GetUserById(claims.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.TokenVersion != claims.TokenVersion {
+		return nil, nil, fmt.Errorf("token has been revoked")
+	}
+	if u.SuspendedAt != nil {
+		return nil, nil, fmt.Errorf("account suspended")
+	}
+	session, err := h.userStore.GetActiveSession(claims.UserId, claims.FamilyId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("token has been revoked")
+	}
+	// logins from before the user's role started requiring 2FA end until they set it up.
+	// an admin impersonating the user has passed their own login
+	if !u.TOTPEnabled && session.ImpersonatorID == nil {
+		required, err := h.userStore.RoleRequiresTwoFactor(u.Role)
+		if err != nil {
+			return nil, nil, err
+		}
+		if required {
+			return nil, nil, fmt.Errorf("two-factor authentication required")
+		}
+	}
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		if err := h.userStore.TouchSession(session.ID); err != nil {
+			log.Println("failed to update session last seen time:", err)
+		}
+	}
+	return u, session, nil
+}
+
+/*
+parseListOptions reads the pagination, sort and filter query parameters of a blog listing:
+?limit= (max 100) &cursor= &sort=newest|oldest|updated|title|published &category= &tag= &author= &from= &to=
+from and to are dates (2006-01-02) or RFC 3339 timestamps
+*/
+func parseListOptions(r *http.Request) (types.BlogListOptions, error) {
+	query := r.URL.Query()
+	opts := types.BlogListOptions{
+		Limit:    20,
+		Cursor:   query.Get("cursor"),
+		Sort:     query.Get("sort"),
+		Category: query.Get("category"),
+		Tag:      query.Get("tag"),
+	}
+
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > 100 {
+			return opts, fmt.Errorf("limit must be between 1 and 100")
+		}
+		opts.Limit = limit
+	}
+	if a := query.Get("author"); a != "" {
+		authorId, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid author id: %w", err)
+		}
+		opts.AuthorId = authorId
+	}
+	for _, p := range []struct {
+		name string
+		dest **time.Time
+	}{{"from", &opts.From}, {"to", &opts.To}} {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, v); err != nil {
+				return opts, fmt.Errorf("invalid %s date: %s", p.name, v)
+			}
+		}
+		*p.dest = &t
+	}
+	return opts, nil
+}
+
 func (h *Handler) RegisterRoutes(router *mux.Router) {
-	// the only public route in this subroute
+	// public routes in this subroute
 	public := router.PathPrefix("/").Subrouter()
 	public.HandleFunc("/blogs", h.handleGetAllBlogs).Methods("GET")
+	public.HandleFunc("/posts/{slug}", h.handleGetBlogBySlug).Methods("GET") // permalink by slug
+	public.HandleFunc("/search", h.handleSearchBlogs).Methods("GET")         // full-text search, ?q=
+	public.HandleFunc("/tags/{name}/blogs", h.handleGetBlogsByTag).Methods("GET")
+	public.HandleFunc("/categories/{slug}/blogs", h.handleGetBlogsByCategory).Methods("GET")
+	public.Use(h.ViewerMiddleware)
 
+	// authenticated routes. writing needs the posts permission, editing and publishing
+	// someone else's post is decided by the store from the editor's role
 	r := router.PathPrefix("/").Subrouter()
-	r.HandleFunc("/blogs", h.handleBlogCreation).Methods("POST") // For creating a blog
+	r.Handle("/blogs", auth.Allow(types.PermissionWritePosts, h.handleBlogCreation)).Methods("POST") // For creating a blog
+
+	r.Handle("/blogs/trash", auth.Allow(types.PermissionWritePosts, h.handleGetTrashedBlogs)).Methods("GET")
+	r.HandleFunc("/users/{userId:[0-9]+}/blogs", h.handleGetAllBlogsByUserId).Methods("GET") // For fetching all blogs of a user
+	r.HandleFunc("/blogs/{id:[0-9]+}", h.handleGetBlogById).Methods("GET")                   // For fetching a single blog by ID
 
-	r.HandleFunc("/blogs/{userId}", h.handleGetAllBlogsByUserId).Methods("GET") // For fetching all blogs
-	r.HandleFunc("/blogs/{id}", h.handleGetBlogById).Methods("GET")             // For fetching a single blog by ID
+	r.Handle("/blogs/{id}", auth.Allow(types.PermissionWritePosts, h.handleBlogUpdate)).Methods("PATCH") // For updating a blog by ID
 
-	r.HandleFunc("/blogs/{id}", h.handleBlogUpdate).Methods("PATCH") // For updating a blog by ID
+	r.Handle("/blogs/{id}/publish", auth.Allow(types.PermissionWritePosts, h.handleBlogStatusChange(types.BlogStatusPublished))).Methods("POST")
+	r.Handle("/blogs/{id}/unpublish", auth.Allow(types.PermissionWritePosts, h.handleBlogStatusChange(types.BlogStatusDraft))).Methods("POST")
+	r.Handle("/blogs/{id}/archive", auth.Allow(types.PermissionWritePosts, h.handleBlogStatusChange(types.BlogStatusArchived))).Methods("POST")
 
-	r.HandleFunc("/blogs/soft/{id}", h.handleBlogSoftDeletion).Methods("DELETE")   // Soft delete
-	r.HandleFunc("/blogs/delete/{id}", h.handleBlogHardDeletion).Methods("DELETE") // Hard delete
+	r.Handle("/blogs/{id}/revisions", auth.Allow(types.PermissionWritePosts, h.handleGetBlogRevisions)).Methods("GET")
+	r.Handle("/blogs/{id}/revisions/diff", auth.Allow(types.PermissionWritePosts, h.handleBlogRevisionDiff)).Methods("GET") // ?from={revisionId}&to={revisionId}
+	r.Handle("/blogs/{id}/revisions/{revisionId:[0-9]+}", auth.Allow(types.PermissionWritePosts, h.handleGetBlogRevision)).Methods("GET")
+	r.Handle("/blogs/{id}/revisions/{revisionId:[0-9]+}/restore", auth.Allow(types.PermissionWritePosts, h.handleRestoreBlogRevision)).Methods("POST")
+
+	r.Handle("/blogs/soft/{id}", auth.Allow(types.PermissionWritePosts, h.handleBlogSoftDeletion)).Methods("DELETE")   // Soft delete
+	r.Handle("/blogs/{id}/restore", auth.Allow(types.PermissionWritePosts, h.handleBlogRestore)).Methods("POST")       // Restore from the trash
+	r.Handle("/blogs/delete/{id}", auth.Allow(types.PermissionWritePosts, h.handleBlogHardDeletion)).Methods("DELETE") // Hard delete
 
 	r.Use(h.AuthMiddleware) // this is to apply the middleware to all the routes under this subrouter
 }
 
 func (h *Handler) handleGetAllBlogs(w http.ResponseWriter, r *http.Request) {
-	blogs, err := h.store.GetAllBlogs()
+	opts, err := parseListOptions(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	blogs, err := h.store.GetAllBlogs(h.viewerId(r), opts)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting blogs: %w", err))
 		return
 	}
-	utils.WriteJSON(w, http.StatusOK, blogs)
+	h.writeBlogPage(w, r, blogs)
+}
+
+// handleSearchBlogs runs a full-text search over published blogs.
+// ?q= is the query, ?limit= (max 100) and ?offset= page through the results
+func (h *Handler) handleSearchBlogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := query.Get("q")
+	if q == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("missing search query"))
+		return
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	results, err := h.store.SearchBlogs(q, limit, offset)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("error searching blogs: %w", err))
+		return
+	}
+	blogs := make([]types.Blog, len(*results))
+	for i, res := range *results {
+		blogs[i] = res.Blog
+	}
+	if err := h.attachReactions(blogs, h.viewerId(r)); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting reactions: %w", err))
+		return
+	}
+	for i := range *results {
+		(*results)[i].Blog = blogs[i]
+	}
+	utils.WriteJSON(w, http.StatusOK, results)
+}
+
+// handleGetBlogsByTag lists the blogs with a tag. it takes the same query parameters as /blogs
+func (h *Handler) handleGetBlogsByTag(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts.Tag = mux.Vars(r)["name"]
+
+	blogs, err := h.store.GetAllBlogs(h.viewerId(r), opts)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting blogs: %w", err))
+		return
+	}
+	h.writeBlogPage(w, r, blogs)
+}
+
+// handleGetBlogsByCategory lists the blogs in a category and all of its descendants.
+// it takes the same query parameters as /blogs
+func (h *Handler) handleGetBlogsByCategory(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts.Category = mux.Vars(r)["slug"]
+
+	blogs, err := h.store.GetAllBlogs(h.viewerId(r), opts)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting blogs: %w", err))
+		return
+	}
+	h.writeBlogPage(w, r, blogs)
 }
 
 func (h *Handler) handleBlogHardDeletion(w http.ResponseWriter, r *http.Request) {
@@ -81,7 +309,9 @@ func (h *Handler) handleBlogHardDeletion(w http.ResponseWriter, r *http.Request)
 	// soft delete the blog
 	if err := h.store.DeleteBlogPermanentlyById(userId, blogId); err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to delete blog: %w", err))
+		return
 	}
+	h.changed()
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "permanently deleted the blog"})
 }
 
@@ -104,9 +334,37 @@ func (h *Handler) handleBlogSoftDeletion(w http.ResponseWriter, r *http.Request)
 		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to delete blog: %w", err))
 		return
 	}
+	h.changed()
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "blog soft delete success"})
 }
 
+// handleGetTrashedBlogs lists the soft deleted blogs of the user
+func (h *Handler) handleGetTrashedBlogs(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	blogs, err := h.store.GetTrashedBlogs(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting deleted blogs: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, blogs)
+}
+
+func (h *Handler) handleBlogRestore(w http.ResponseWriter, r *http.Request) {
+	blogId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+
+	if err := h.store.RestoreBlogById(userId, blogId); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("failed to restore blog: %w", err))
+		return
+	}
+	h.changed()
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "blog restored successfully"})
+}
+
 func (h *Handler) handleBlogUpdate(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	blogId, err := strconv.ParseInt(vars["id"], 10, 64)
@@ -121,29 +379,62 @@ func (h *Handler) handleBlogUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 	// get the blog body
 	var b types.Blog
-	if err := utils.ParseJSON(r, &b); err != nil {
+	fields, err := utils.ParseJSONFields(r, &b)
+	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
 		return
 	}
+	// "publish_at": null unschedules the blog, leaving it out keeps the schedule
+	raw, sent := fields["publish_at"]
+	unschedule := sent && utils.IsJSONNull(raw)
 	// validate the blog body
 	if err := utils.Validate.Struct(b); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
 		return
 	}
+	if b.PublishAt != nil && !b.PublishAt.After(time.Now()) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("publish_at must be in the future"))
+		return
+	}
 
-	if err := h.store.UpdateBlogById(userId, blogId, b); err != nil {
+	if err := h.store.UpdateBlogById(auth.BlogEditor(r), blogId, b, unschedule); err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update blog: %w", err))
 		return
 	}
+	h.changed()
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "blog updated successfully"})
 }
 
+// handleBlogStatusChange returns a handler that moves the blog to the given status.
+// publish, unpublish and archive only differ in the status they set
+func (h *Handler) handleBlogStatusChange(status types.BlogStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		blogId, err := strconv.ParseInt(vars["id"], 10, 64)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+			return
+		}
+		userId := r.Context().Value(types.UserIDKey).(int64)
+		if userId == 0 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err := h.store.UpdateBlogStatusById(auth.BlogEditor(r), blogId, status); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update blog status: %w", err))
+			return
+		}
+		h.changed()
+		utils.WriteJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("blog is now %s", status)})
+	}
+}
+
 func (h *Handler) handleGetAllBlogsByUserId(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
-	userId, err := strconv.ParseInt(vars["id"], 10, 64)
+	userId, err := strconv.ParseInt(vars["userId"], 10, 64)
 
-	term := r.URL.Query().Get("term")
 	if userId == 0 || err != nil {
 		userId = r.Context().Value(types.UserIDKey).(int64)
 	}
@@ -151,13 +442,19 @@ func (h *Handler) handleGetAllBlogsByUserId(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	opts, err := parseListOptions(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts.Term = r.URL.Query().Get("term")
 	// get all the blogs for the user
-	blogs, err := h.store.GetAllBlogsByUserId(userId, term)
+	blogs, err := h.store.GetAllBlogsByUserId(userId, r.Context().Value(types.UserIDKey).(int64), opts)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting blogs: %w", err))
 		return
 	}
-	utils.WriteJSON(w, http.StatusOK, blogs)
+	h.writeBlogPage(w, r, blogs)
 }
 
 func (h *Handler) handleGetBlogById(w http.ResponseWriter, r *http.Request) {
@@ -174,8 +471,67 @@ func (h *Handler) handleGetBlogById(w http.ResponseWriter, r *http.Request) {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
+	h.writeBlog(w, r, b)
+}
 
-	utils.WriteJSON(w, http.StatusOK, b)
+// handleGetBlogBySlug serves the permalink of a blog. old slugs redirect to the current one
+func (h *Handler) handleGetBlogBySlug(w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+	b, err := h.store.GetBlogBySlug(slug)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("blog not found"))
+		return
+	}
+	if b.Slug != slug {
+		url, err := mux.CurrentRoute(r).URLPath("slug", b.Slug)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
+		return
+	}
+	h.writeBlog(w, r, b)
+}
+
+// writeBlog writes a single blog response, hiding unpublished blogs from everyone but their author and editors
+func (h *Handler) writeBlog(w http.ResponseWriter, r *http.Request, b *types.Blog) {
+	viewerId := h.viewerId(r)
+	if !auth.BlogEditor(r).CanView(b) {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("blog not found"))
+		return
+	}
+	blogs := []types.Blog{*b}
+	if err := h.attachReactions(blogs, viewerId); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting reactions: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, blogs[0])
+}
+
+// writeBlogPage writes a page of a blog listing, with the reactions of every blog
+func (h *Handler) writeBlogPage(w http.ResponseWriter, r *http.Request, page *types.BlogPage) {
+	if err := h.attachReactions(page.Data, h.viewerId(r)); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting reactions: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, page)
+}
+
+// attachReactions fills in the reaction counts of the blogs, and the viewer's own reaction
+func (h *Handler) attachReactions(blogs []types.Blog, viewerId int64) error {
+	ids := make([]uint, 0, len(blogs))
+	for _, b := range blogs {
+		ids = append(ids, b.ID)
+	}
+	summaries, err := h.reactionStore.GetReactionSummaries(types.ReactionTargetBlog, ids, viewerId)
+	if err != nil {
+		return err
+	}
+	for i := range blogs {
+		blogs[i].Reactions = summaries[blogs[i].ID]
+	}
+	return nil
 }
 
 func (h *Handler) handleBlogCreation(w http.ResponseWriter, r *http.Request) {
@@ -203,6 +559,11 @@ func (h *Handler) handleBlogCreation(w http.ResponseWriter, r *http.Request) {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
+	// a blog can be scheduled to be published later by the background publisher
+	if b.PublishAt != nil && !b.PublishAt.After(time.Now()) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("publish_at must be in the future"))
+		return
+	}
 
 	b.UserId = uint(userId)
 	// create the blog
@@ -211,5 +572,99 @@ func (h *Handler) handleBlogCreation(w http.ResponseWriter, r *http.Request) {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
+	h.changed()
 	utils.WriteJSON(w, http.StatusCreated, map[string]string{"message": "blog created successfully"})
 }
+
+func (h *Handler) handleGetBlogRevisions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	blogId, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+		return
+	}
+	editor := auth.BlogEditor(r)
+
+	revisions, err := h.store.GetBlogRevisions(editor, blogId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("error getting revisions: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, revisions)
+}
+
+func (h *Handler) handleGetBlogRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	blogId, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+		return
+	}
+	revisionId, err := strconv.ParseInt(vars["revisionId"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid revision id: %w", err))
+		return
+	}
+	editor := auth.BlogEditor(r)
+
+	rev, err := h.store.GetBlogRevisionById(editor, blogId, revisionId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("error getting revision: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, rev)
+}
+
+// handleBlogRevisionDiff shows a line-level diff between the two revisions given by ?from= and ?to=
+func (h *Handler) handleBlogRevisionDiff(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	blogId, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+		return
+	}
+	fromId, err := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid from revision id: %w", err))
+		return
+	}
+	toId, err := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid to revision id: %w", err))
+		return
+	}
+	editor := auth.BlogEditor(r)
+
+	from, err := h.store.GetBlogRevisionById(editor, blogId, fromId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("error getting revision: %w", err))
+		return
+	}
+	to, err := h.store.GetBlogRevisionById(editor, blogId, toId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("error getting revision: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, DiffRevisions(*from, *to))
+}
+
+func (h *Handler) handleRestoreBlogRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	blogId, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+		return
+	}
+	revisionId, err := strconv.ParseInt(vars["revisionId"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid revision id: %w", err))
+		return
+	}
+
+	if err := h.store.RestoreBlogRevision(auth.BlogEditor(r), blogId, revisionId); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to restore revision: %w", err))
+		return
+	}
+	h.changed()
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "revision restored successfully"})
+}
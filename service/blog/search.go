@@ -0,0 +1,66 @@
+package blog
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// markers wrapped around matched words by ts_headline. they can't appear in
+// stored text, so they are swapped for <mark> tags after the snippet is escaped
+const (
+	startSel = "\x02"
+	stopSel  = "\x03"
+)
+
+// searchHeadlineOptions are the ts_headline options used for the snippets
+var searchHeadlineOptions = "StartSel=" + startSel + ",StopSel=" + stopSel + ",MaxFragments=2,MaxWords=30,MinWords=10,FragmentDelimiter= … "
+
+/*
+buildTSQuery turns a user search query into a tsquery sql expression and its arguments.
+"quoted text" is a phrase query, a trailing * makes a prefix query (go*) and every
+other word must match. each part becomes its own bound parameter, so nothing in q
+reaches the sql text.
+@returns: expression, args. the expression is empty when q has no searchable words
+*/
+func buildTSQuery(q string) (string, []any) {
+	var parts []string
+	var args []any
+
+	for i, chunk := range strings.Split(q, `"`) {
+		// odd chunks were inside quotes
+		if i%2 == 1 {
+			if strings.TrimSpace(chunk) != "" {
+				parts = append(parts, "phraseto_tsquery('english', ?)")
+				args = append(args, chunk)
+			}
+			continue
+		}
+		for _, word := range strings.Fields(chunk) {
+			if strings.HasSuffix(word, "*") {
+				// only letters and digits are kept so the prefix is a valid tsquery lexeme
+				prefix := strings.Map(func(r rune) rune {
+					if unicode.IsLetter(r) || unicode.IsDigit(r) {
+						return unicode.ToLower(r)
+					}
+					return -1
+				}, word)
+				if prefix != "" {
+					parts = append(parts, "to_tsquery('simple', ? || ':*')")
+					args = append(args, prefix)
+				}
+				continue
+			}
+			parts = append(parts, "plainto_tsquery('english', ?)")
+			args = append(args, word)
+		}
+	}
+	return strings.Join(parts, " && "), args
+}
+
+// highlight html escapes a ts_headline result and marks the matched words with <mark>
+func highlight(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, startSel, "<mark>")
+	return strings.ReplaceAll(s, stopSel, "</mark>")
+}
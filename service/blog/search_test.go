@@ -0,0 +1,84 @@
+package blog
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/izumii.cxde/blog-api/config"
+	"github.com/izumii.cxde/blog-api/storage"
+	"github.com/izumii.cxde/blog-api/types"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// every placeholder of the search must get the argument meant for it
+func TestSearchQueryBindsInOrder(t *testing.T) {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsquery, args := buildTSQuery(`go "full text" data*`)
+	stmt := searchQuery(db, tsquery, args, 20, 40).Statement
+	sql := db.Dialector.Explain(stmt.SQL.String(), stmt.Vars...)
+
+	for _, want := range []string{
+		"q.query, '" + searchHeadlineOptions + "') AS snippet",
+		"(SELECT plainto_tsquery('english', 'go') && phraseto_tsquery('english', 'full text') && to_tsquery('simple', 'data' || ':*') AS query) q",
+		"b.status = '" + string(types.BlogStatusPublished) + "'",
+		"LIMIT 20 OFFSET 40",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("search query does not contain %q:\n%s", want, sql)
+		}
+	}
+}
+
+// TestSearchBlogs runs a search against the database of TEST_DATABASE_URL, inside a transaction that is rolled back
+func TestSearchBlogs(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := storage.NewPostgresStorage(config.Config{DBAddress: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := db.Begin()
+	t.Cleanup(func() { tx.Rollback() })
+
+	u := types.User{FirstName: "Search", LastName: "Test", Email: "search-test@example.com", Password: "x", AvatarUrl: "x"}
+	c := types.Category{Name: "Search test", Slug: "search-test"}
+	if err := tx.Create(&u).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Create(&c).Error; err != nil {
+		t.Fatal(err)
+	}
+	blogs := []types.Blog{
+		{Title: "Postgres full text search", Slug: "search-test-match", Description: "ranking with tsvector",
+			Content: "searching blogs with postgres", CategoryID: c.ID, UserId: u.ID, Status: types.BlogStatusPublished},
+		{Title: "Unrelated", Slug: "search-test-other", Description: "nothing to see",
+			Content: "cooking recipes", CategoryID: c.ID, UserId: u.ID, Status: types.BlogStatusPublished},
+		{Title: "Postgres draft", Slug: "search-test-draft", Description: "not published yet",
+			Content: "postgres notes", CategoryID: c.ID, UserId: u.ID, Status: types.BlogStatusDraft},
+	}
+	if err := tx.Omit("Tags", "Category").Create(&blogs).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := RefreshSearchVector(tx.Where("category_id = ?", c.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := NewStore(tx).SearchBlogs(`postgres "full text" search*`, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*results) != 1 || (*results)[0].Blog.ID != blogs[0].ID {
+		t.Fatalf("got %+v, want only the published match", *results)
+	}
+	if !strings.Contains((*results)[0].TitleHighlight, "<mark>Postgres</mark>") {
+		t.Errorf("title highlight %q does not mark the match", (*results)[0].TitleHighlight)
+	}
+}
@@ -1,12 +1,16 @@
 package blog
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/izumii.cxde/blog-api/markdown"
 	"github.com/izumii.cxde/blog-api/types"
 	"github.com/izumii.cxde/blog-api/utils"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Store struct {
@@ -20,15 +24,152 @@ func NewStore(db *gorm.DB) *Store {
 /*
 UpdateBlogById updates a blog by its id
 @params:
-userId - the id of the user
+editor - the user making the change, who must own the blog unless they can edit any blog
 id - the id of the blog
 b - the blog to update
+unschedule - clear publish_at, so a scheduled draft is no longer published automatically
+
+@returns:
+error - if there was an error
+*/
+func (s *Store) UpdateBlogById(editor types.BlogEditor, id int64, b types.Blog, unschedule bool) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// tags left out of the update are kept
+		if err := updateBlog(tx, editor, id, b, len(b.Tags) > 0); err != nil {
+			return err
+		}
+		if !unschedule {
+			return nil
+		}
+		return tx.Model(&types.Blog{}).Where("id = ?", id).Update("publish_at", nil).Error
+	})
+}
+
+// updateBlog writes the blog and records the result as a new revision. replaceTags sets the
+// tags to exactly b.Tags, even when there are none. it must be called inside a transaction
+func updateBlog(tx *gorm.DB, editor types.BlogEditor, id int64, b types.Blog, replaceTags bool) error {
+	// blogs written before revisions existed get their current state saved first,
+	// so the text being overwritten is never lost
+	if err := saveBaselineRevision(tx, id); err != nil {
+		return err
+	}
+
+	if b.CategoryID != 0 {
+		if err := categoryExists(tx, b.CategoryID); err != nil {
+			return err
+		}
+	}
+	b.Category = nil
+
+	var current types.Blog
+	if err := tx.Scopes(editableBy(editor)).Select("title", "slug").Where("id = ? AND deleted_at is NULL", id).First(&current).Error; err != nil {
+		return fmt.Errorf("no blog found")
+	}
+
+	// the status can only be changed through UpdateBlogStatusById
+	b.Status = ""
+	b.PublishedAt = nil
+	// the slug follows the title, it can't be set directly
+	b.Slug = ""
+	// comments are locked through SetBlogCommentsLocked
+	b.CommentsLocked = false
+	if b.Title != "" && b.Title != current.Title {
+		slug, err := changeSlug(tx, id, current.Slug, b.Title)
+		if err != nil {
+			return err
+		}
+		b.Slug = slug
+	}
+	// the html is always rendered from the content, it can't be set directly
+	b.ContentHTML = ""
+	if b.Content != "" {
+		html, err := markdown.Render(b.Content)
+		if err != nil {
+			return fmt.Errorf("failed to render content: %w", err)
+		}
+		b.ContentHTML = html
+	}
+	tags := b.Tags
+	b.Tags = nil
+	res := tx.Model(&types.Blog{}).Scopes(editableBy(editor)).Where("id = ? AND deleted_at is NULL", id).Omit("Tags", "Category").Updates(b)
+
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("no blog found")
+	}
+
+	if replaceTags {
+		tags, err := findOrCreateTags(tx, tags)
+		if err != nil {
+			return err
+		}
+		association := tx.Model(&types.Blog{Model: gorm.Model{ID: uint(id)}}).Association("Tags")
+		if len(tags) == 0 {
+			err = association.Clear()
+		} else {
+			err = association.Replace(tags)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := RefreshSearchVector(tx.Where("id = ?", id)); err != nil {
+		return err
+	}
+	return saveRevision(tx, id, uint(editor.UserId))
+}
+
+// editableBy limits a blog query to the blogs the editor may change
+func editableBy(editor types.BlogEditor) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if editor.AnyBlog {
+			return db
+		}
+		return db.Where("user_id = ?", editor.UserId)
+	}
+}
+
+// findOrCreateTags returns the stored tags for the given tag names, creating the missing ones.
+// names are normalised first, so "Go" and "go " end up as the same tag
+func findOrCreateTags(tx *gorm.DB, names []types.Tag) ([]types.Tag, error) {
+	var tags []types.Tag
+	seen := map[string]bool{}
+	for _, tagName := range names {
+		name := utils.NormalizeTag(tagName.Name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		var tag types.Tag
+		if err := tx.FirstOrCreate(&tag, types.Tag{Name: name}).Error; err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+/*
+UpdateBlogStatusById moves a blog to the given lifecycle status
+@params:
+editor - the user making the change, who must own the blog unless they can edit any blog
+id - the id of the blog
+status - the new status of the blog
 
 @returns:
 error - if there was an error
 */
-func (s *Store) UpdateBlogById(userId, id int64, b types.Blog) error {
-	res := s.db.Model(&types.Blog{}).Where("user_id = ? AND id = ? AND deleted_at is NULL", userId, id).Updates(b)
+func (s *Store) UpdateBlogStatusById(editor types.BlogEditor, id int64, status types.BlogStatus) error {
+	// an explicit status change always cancels any pending schedule
+	fields := map[string]any{"status": status, "publish_at": nil}
+	if status == types.BlogStatusPublished {
+		fields["published_at"] = time.Now()
+	}
+	res := s.db.Model(&types.Blog{}).Scopes(editableBy(editor)).Where("id = ? AND deleted_at is NULL", id).Updates(fields)
 
 	if res.Error != nil {
 		return res.Error
@@ -39,6 +180,43 @@ func (s *Store) UpdateBlogById(userId, id int64, b types.Blog) error {
 	return nil
 }
 
+/*
+SetBlogCommentsLocked locks or unlocks the comments of a blog
+@params:
+userId - the id of the user, who must own the blog
+id - the id of the blog
+locked - whether new comments and edits are blocked
+*/
+func (s *Store) SetBlogCommentsLocked(userId, id int64, locked bool) error {
+	res := s.db.Model(&types.Blog{}).Where("user_id = ? AND id = ? AND deleted_at is NULL", userId, id).Update("comments_locked", locked)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("no blog found")
+	}
+	return nil
+}
+
+/*
+PublishDueBlogs publishes every draft whose publish_at has passed.
+This is a single UPDATE, and the status check in the WHERE clause is re-evaluated
+under the row lock, so when several replicas run it at once a blog is only ever
+published by one of them.
+@params: now - the time to compare publish_at against
+@returns: the number of published blogs, error
+*/
+func (s *Store) PublishDueBlogs(now time.Time) (int64, error) {
+	res := s.db.Model(&types.Blog{}).
+		Where("status = ? AND publish_at IS NOT NULL AND publish_at <= ?", types.BlogStatusDraft, now).
+		Updates(map[string]any{
+			"status":       types.BlogStatusPublished,
+			"published_at": gorm.Expr("publish_at"),
+			"publish_at":   nil,
+		})
+	return res.RowsAffected, res.Error
+}
+
 func (s *Store) CreateBlog(b types.Blog) error {
 	// Validate the blog object
 	errs := utils.Validate.Struct(b)
@@ -47,20 +225,41 @@ func (s *Store) CreateBlog(b types.Blog) error {
 		return errs
 	}
 
-	// Find or create tags based on the provided tag names
-	var tags []types.Tag
-	for _, tagName := range b.Tags {
-		var tag types.Tag
-		if err := s.db.FirstOrCreate(&tag, types.Tag{Name: tagName.Name}).Error; err != nil {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := categoryExists(tx, b.CategoryID); err != nil {
 			return err
 		}
-		tags = append(tags, tag)
-	}
-	// Assign the tags to the blog (many-to-many relationship)
-	b.Tags = tags
+		// Find or create tags based on the provided tag names
+		tags, err := findOrCreateTags(tx, b.Tags)
+		if err != nil {
+			return err
+		}
+		// Assign the tags to the blog (many-to-many relationship)
+		b.Tags = tags
+		// every new blog starts as a draft until it is explicitly published
+		b.Status = types.BlogStatusDraft
+		b.PublishedAt = nil
+		b.CommentsLocked = false
+		b.Slug, err = uniqueSlug(tx, 0, b.Title)
+		if err != nil {
+			return err
+		}
+		b.ContentHTML, err = markdown.Render(b.Content)
+		if err != nil {
+			return fmt.Errorf("failed to render content: %w", err)
+		}
 
-	// Create the blog
-	return s.db.Create(&b).Error
+		// Create the blog
+		b.Category = nil
+		if err := tx.Create(&b).Error; err != nil {
+			return err
+		}
+		if err := RefreshSearchVector(tx.Where("id = ?", b.ID)); err != nil {
+			return err
+		}
+		// the first revision is the blog as it was created
+		return saveRevision(tx, int64(b.ID), b.UserId)
+	})
 }
 
 /*
@@ -78,60 +277,264 @@ If the blog doesn't exist, it returns nil with an error
 func (s *Store) GetBlogById(id int64) (*types.Blog, error) {
 	var b types.Blog
 	// The preload is used to eager load the tags relationship
-	if err := s.db.Preload("Tags").First(&b, id).Error; err != nil {
+	if err := s.db.Preload("Tags").Preload("Category").First(&b, id).Error; err != nil {
 		return nil, err
 	}
 	return &b, nil
 }
 
 /*
-Get all blogs from the database
-@return - blogs array, error
+GetBlogBySlug returns a blog by its current slug, or by any slug it had before.
+callers can compare the returned blog's Slug with the requested one to redirect old links
+@params: slug - the slug of the blog
 */
-func (s *Store) GetAllBlogs() (*[]types.Blog, error) {
+func (s *Store) GetBlogBySlug(slug string) (*types.Blog, error) {
+	var b types.Blog
+	err := s.db.Preload("Tags").Preload("Category").Where("slug = ?", slug).First(&b).Error
+	if err == nil {
+		return &b, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	// look for a previous slug of the blog
+	var old types.BlogSlug
+	if err := s.db.Where("slug = ?", slug).First(&old).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Preload("Tags").Preload("Category").First(&b, old.BlogID).Error; err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+/*
+BackfillSlugs generates slugs for blogs created before slugs existed
+*/
+func (s *Store) BackfillSlugs() error {
 	var blogs []types.Blog
-	if err := s.db.Preload("Tags").Find(&blogs).Error; err != nil {
+	if err := s.db.Unscoped().Select("id", "title").Where("slug IS NULL OR slug = ''").Find(&blogs).Error; err != nil {
+		return err
+	}
+	for _, b := range blogs {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			slug, err := uniqueSlug(tx, int64(b.ID), b.Title)
+			if err != nil {
+				return err
+			}
+			return tx.Model(&types.Blog{}).Unscoped().Where("id = ?", b.ID).Update("slug", slug).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+BackfillContentHTML renders the content of blogs created before rendered html was stored
+*/
+func (s *Store) BackfillContentHTML() error {
+	var blogs []types.Blog
+	if err := s.db.Unscoped().Select("id", "content").Where("content_html IS NULL OR content_html = ''").Find(&blogs).Error; err != nil {
+		return err
+	}
+	for _, b := range blogs {
+		html, err := markdown.Render(b.Content)
+		if err != nil {
+			return err
+		}
+		if err := s.db.Model(&types.Blog{}).Unscoped().Where("id = ?", b.ID).Update("content_html", html).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+BackfillSearchVectors builds the search document of blogs created before full-text search existed
+*/
+func (s *Store) BackfillSearchVectors() error {
+	return RefreshSearchVector(s.db.Where("search_vector IS NULL"))
+}
+
+/*
+SearchBlogs runs a ranked full-text search over all published blogs
+@params:
+q - the search query. supports "phrases" and prefix* words
+limit, offset - the page of results to return
+@returns: the results, best match first
+*/
+func (s *Store) SearchBlogs(q string, limit, offset int) (*[]types.SearchResult, error) {
+	tsquery, args := buildTSQuery(q)
+	if tsquery == "" {
+		return nil, fmt.Errorf("empty search query")
+	}
+
+	var rows []struct {
+		ID             uint
+		Rank           float64
+		TitleHighlight string
+		Snippet        string
+	}
+	err := searchQuery(s.db, tsquery, args, limit, offset).Scan(&rows).Error
+	if err != nil {
 		return nil, err
 	}
 
-	if len(blogs) == 0 {
-		return nil, fmt.Errorf("no blogs found")
+	// load the matched blogs with their tags, then put them back in rank order
+	ids := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	var blogs []types.Blog
+	if len(ids) > 0 {
+		if err := s.db.Preload("Tags").Preload("Category").Find(&blogs, ids).Error; err != nil {
+			return nil, err
+		}
+	}
+	byId := make(map[uint]types.Blog, len(blogs))
+	for _, b := range blogs {
+		byId[b.ID] = b
 	}
 
-	return &blogs, nil
+	results := make([]types.SearchResult, 0, len(rows))
+	for _, row := range rows {
+		results = append(results, types.SearchResult{
+			Blog:           byId[row.ID],
+			Rank:           row.Rank,
+			TitleHighlight: highlight(row.TitleHighlight),
+			Snippet:        highlight(row.Snippet),
+		})
+	}
+	return &results, nil
+}
+
+/*
+searchQuery builds the ranked full-text search over published blogs. the arguments are bound in the
+order of their placeholders: the snippet options, the words of the tsquery, then status and the page
+@params: tsquery, args - the expression and its arguments from buildTSQuery
+*/
+func searchQuery(db *gorm.DB, tsquery string, args []any, limit, offset int) *gorm.DB {
+	vars := append([]any{searchHeadlineOptions}, args...)
+	vars = append(vars, types.BlogStatusPublished, limit, offset)
+	return db.Raw(`
+		SELECT b.id,
+			ts_rank(b.search_vector, q.query) AS rank,
+			ts_headline('english', b.title, q.query, 'HighlightAll=true, StartSel=`+startSel+`, StopSel=`+stopSel+`') AS title_highlight,
+			ts_headline('english', b.description || ' ' || b.content, q.query, ?) AS snippet
+		FROM blogs b, (SELECT `+tsquery+` AS query) q
+		WHERE b.search_vector @@ q.query AND b.status = ? AND b.deleted_at IS NULL
+		ORDER BY rank DESC, b.id DESC
+		LIMIT ? OFFSET ?`, vars...)
+}
+
+/*
+Get a page of published blogs from the database, along with the viewer's own drafts
+@params:
+viewerId - the id of the requesting user, 0 for anonymous requests
+opts - the page, sort order and filters
+@return - the page of blogs, error
+*/
+func (s *Store) GetAllBlogs(viewerId int64, opts types.BlogListOptions) (*types.BlogPage, error) {
+	visible := s.db.Where("status = ?", types.BlogStatusPublished)
+	if viewerId != 0 {
+		visible = visible.Or("user_id = ? AND status = ?", viewerId, types.BlogStatusDraft)
+	}
+	query := s.db.Where(visible)
+	if opts.AuthorId != 0 {
+		query = query.Where("user_id = ?", opts.AuthorId)
+	}
+	return listBlogs(query, opts)
 }
 
 /*
-GetAllBlogsByUserId returns all the blogs for a given user
+GetAllBlogsByUserId returns a page of the blogs for a given user
 @params:
 
 	userId - the id of the user
+	viewerId - the id of the requesting user. Only the owner sees unpublished blogs
+	opts - the page, sort order and filters. Term searches the title, description and category
 
 @returns:
 
-	blogs - a slice of blogs
+	blogs - a page of blogs
 */
-func (s *Store) GetAllBlogsByUserId(userId int64, term string) (*[]types.Blog, error) {
-	var blogs []types.Blog
+func (s *Store) GetAllBlogsByUserId(userId, viewerId int64, opts types.BlogListOptions) (*types.BlogPage, error) {
 	// Start building the query with the user_id filter and deleted_at check
-	query := s.db.Preload("Tags").Where("user_id = ? AND deleted_at is NULL", userId)
+	query := s.db.Where("user_id = ? AND deleted_at is NULL", userId)
+	if userId != viewerId {
+		query = query.Where("status = ?", types.BlogStatusPublished)
+	}
 	// If a search term is provided, filter the results based on the term
-	if term != "" {
-		query = query.Where("title LIKE ? OR description LIKE ? OR category LIKE ?", "%"+term+"%", "%"+term+"%", "%"+term+"%")
+	if opts.Term != "" {
+		term := "%" + opts.Term + "%"
+		query = query.Where("(title LIKE ? OR description LIKE ? OR category_id IN (SELECT id FROM categories WHERE name LIKE ?))", term, term, term)
 	}
+	return listBlogs(query, opts)
+}
 
-	// Execute the query
-	if err := query.Find(&blogs).Error; err != nil {
-		return nil, err
+// listBlogs applies the filters, sort order and cursor to the query and loads one page of blogs.
+// pages are keyset paginated on (sort column, id), so they stay stable while blogs are added
+func listBlogs(query *gorm.DB, opts types.BlogListOptions) (*types.BlogPage, error) {
+	if opts.Sort == "" {
+		opts.Sort = types.BlogSortNewest
+	}
+	order, ok := sortColumns[opts.Sort]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort order: %s", opts.Sort)
 	}
 
-	// If no blogs are found, return an error
-	if len(blogs) == 0 {
-		return nil, fmt.Errorf("no blogs found")
+	if opts.Category != "" {
+		// the category and everything nested below it
+		query = query.Where(`category_id IN (
+			WITH RECURSIVE tree AS (
+				SELECT id FROM categories WHERE slug = ?
+				UNION ALL
+				SELECT categories.id FROM categories JOIN tree ON categories.parent_id = tree.id
+			)
+			SELECT id FROM tree)`, opts.Category)
+	}
+	if opts.Tag != "" {
+		query = query.Where(`EXISTS (SELECT 1 FROM blog_tags JOIN tags ON tags.id = blog_tags.tag_id
+			WHERE blog_tags.blog_id = blogs.id AND tags.name = ?)`, utils.NormalizeTag(opts.Tag))
+	}
+	if opts.From != nil {
+		query = query.Where("created_at >= ?", *opts.From)
+	}
+	if opts.To != nil {
+		query = query.Where("created_at < ?", *opts.To)
 	}
 
-	// Return the found blogs
-	return &blogs, nil
+	direction, cmp := "ASC", ">"
+	if order.desc {
+		direction, cmp = "DESC", "<"
+	}
+	if opts.Cursor != "" {
+		c, value, err := decodeCursor(opts.Cursor, opts.Sort)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where(fmt.Sprintf("(%s, id) %s (?, ?)", order.column, cmp), value, c.ID)
+	}
+
+	// one extra row tells us whether there is a next page
+	var blogs []types.Blog
+	err := query.Preload("Tags").Preload("Category").
+		Order(fmt.Sprintf("%s %s, id %s", order.column, direction, direction)).
+		Limit(opts.Limit + 1).
+		Find(&blogs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	page := types.BlogPage{Data: blogs}
+	if len(blogs) > opts.Limit {
+		page.Data = blogs[:opts.Limit]
+		page.NextCursor = encodeCursor(opts.Sort, page.Data[opts.Limit-1])
+	}
+	return &page, nil
 }
 
 /*
@@ -161,10 +564,317 @@ id - the id of the blog
 error - if there was an error
 */
 func (s *Store) DeleteBlogPermanentlyById(userId, id int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		err := tx.Unscoped().Model(&types.Blog{}).
+			Where("user_id = ? AND id = ?", userId, id).
+			Pluck("id", &ids).Error
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("no blog found")
+		}
+		return PurgeBlogs(tx, ids)
+	})
+}
+
+/*
+GetTrashedBlogs returns the soft deleted blogs of a user, most recently deleted first
+@params: userId - the owner of the blogs
+*/
+func (s *Store) GetTrashedBlogs(userId int64) (*[]types.Blog, error) {
+	var blogs []types.Blog
+	err := s.db.Unscoped().Preload("Tags").Preload("Category").
+		Where("user_id = ? AND deleted_at IS NOT NULL", userId).
+		Order("deleted_at DESC, id DESC").
+		Find(&blogs).Error
+	if err != nil {
+		return nil, err
+	}
+	return &blogs, nil
+}
 
-	res := s.db.Unscoped().Where("user_id = ? AND id = ?", userId, id).Delete(&types.Blog{})
+/*
+RestoreBlogById moves a soft deleted blog out of the trash. it keeps the status it had
+@params: userId - the owner of the blog, id - the id of the blog
+*/
+func (s *Store) RestoreBlogById(userId, id int64) error {
+	res := s.db.Unscoped().Model(&types.Blog{}).
+		Where("user_id = ? AND id = ? AND deleted_at IS NOT NULL", userId, id).
+		Update("deleted_at", nil)
+	if res.Error != nil {
+		return res.Error
+	}
 	if res.RowsAffected == 0 {
+		return fmt.Errorf("no deleted blog found")
+	}
+	return nil
+}
+
+/*
+PurgeDeletedBlogs permanently deletes the blogs that were soft deleted before the given time
+@returns: the number of blogs deleted
+*/
+func (s *Store) PurgeDeletedBlogs(before time.Time) (int64, error) {
+	var ids []uint
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(&types.Blog{}).
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", before).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		return PurgeBlogs(tx, ids)
+	})
+	return int64(len(ids)), err
+}
+
+/*
+PurgeBlogs hard deletes blogs together with everything that belongs to them: tag links,
+revisions, old slugs, comments and reactions. bookmarks and reading list items are removed
+by their foreign keys. it runs in the caller's transaction, so other stores can use it too
+*/
+func PurgeBlogs(tx *gorm.DB, ids []uint) error {
+	comments := tx.Unscoped().Model(&types.Comment{}).Select("id").Where("blog_id IN ?", ids)
+	steps := []struct {
+		model any
+		query string
+		args  []any
+	}{
+		{&types.Reaction{}, "target_type = ? AND target_id IN (?)", []any{types.ReactionTargetComment, comments}},
+		{&types.ReactionCount{}, "target_type = ? AND target_id IN (?)", []any{types.ReactionTargetComment, comments}},
+		{&types.Reaction{}, "target_type = ? AND target_id IN ?", []any{types.ReactionTargetBlog, ids}},
+		{&types.ReactionCount{}, "target_type = ? AND target_id IN ?", []any{types.ReactionTargetBlog, ids}},
+		{&types.Comment{}, "blog_id IN ?", []any{ids}},
+		{&types.BlogTag{}, "blog_id IN ?", []any{ids}},
+		{&types.BlogRevision{}, "blog_id IN ?", []any{ids}},
+		{&types.BlogSlug{}, "blog_id IN ?", []any{ids}},
+		{&types.Blog{}, "id IN ?", []any{ids}},
+	}
+	for _, step := range steps {
+		if err := tx.Unscoped().Where(step.query, step.args...).Delete(step.model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revisionFromBlog builds an (unsaved) revision snapshot of the blog
+func revisionFromBlog(b types.Blog, editorId uint) types.BlogRevision {
+	tags := make([]string, 0, len(b.Tags))
+	for _, t := range b.Tags {
+		tags = append(tags, t.Name)
+	}
+	rev := types.BlogRevision{
+		BlogID:      b.ID,
+		Title:       b.Title,
+		Description: b.Description,
+		Content:     b.Content,
+		CategoryID:  b.CategoryID,
+		Tags:        tags,
+		EditorID:    editorId,
+	}
+	if b.Category != nil {
+		rev.Category = b.Category.Name
+	}
+	return rev
+}
+
+// saveRevision snapshots the current state of the blog as its next revision
+func saveRevision(tx *gorm.DB, blogId int64, editorId uint) error {
+	// the blog row is locked so concurrent writers get consecutive versions
+	var b types.Blog
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Tags").Preload("Category").First(&b, blogId).Error; err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.Model(&types.BlogRevision{}).Where("blog_id = ?", blogId).
+		Select("COALESCE(MAX(version), 0)").Scan(&version).Error; err != nil {
+		return err
+	}
+
+	rev := revisionFromBlog(b, editorId)
+	rev.Version = version + 1
+	return tx.Create(&rev).Error
+}
+
+// saveBaselineRevision saves the current state of a blog that has no revisions yet
+func saveBaselineRevision(tx *gorm.DB, blogId int64) error {
+	var count int64
+	if err := tx.Model(&types.BlogRevision{}).Where("blog_id = ?", blogId).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	var b types.Blog
+	if err := tx.Preload("Tags").Preload("Category").First(&b, blogId).Error; err != nil {
+		// a missing blog is reported by the update itself
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	rev := revisionFromBlog(b, b.UserId)
+	rev.Version = 1
+	rev.CreatedAt = b.UpdatedAt
+	return tx.Create(&rev).Error
+}
+
+// blogEditableBy checks that the blog exists and the editor may change it
+func blogEditableBy(db *gorm.DB, editor types.BlogEditor, blogId int64) error {
+	var count int64
+	if err := db.Model(&types.Blog{}).Scopes(editableBy(editor)).Where("id = ?", blogId).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
 		return fmt.Errorf("no blog found")
 	}
-	return res.Error
+	return nil
+}
+
+/*
+GetBlogRevisions returns every revision of a blog, newest first
+@params:
+editor - the user asking, who must own the blog unless they can edit any blog
+blogId - the id of the blog
+*/
+func (s *Store) GetBlogRevisions(editor types.BlogEditor, blogId int64) (*[]types.BlogRevision, error) {
+	if err := blogEditableBy(s.db, editor, blogId); err != nil {
+		return nil, err
+	}
+	var revisions []types.BlogRevision
+	if err := s.db.Where("blog_id = ?", blogId).Order("version DESC").Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+	return &revisions, nil
+}
+
+/*
+GetBlogRevisionById returns a single revision of a blog
+@params:
+editor - the user asking, who must own the blog unless they can edit any blog
+blogId - the id of the blog
+revisionId - the id of the revision
+*/
+func (s *Store) GetBlogRevisionById(editor types.BlogEditor, blogId, revisionId int64) (*types.BlogRevision, error) {
+	if err := blogEditableBy(s.db, editor, blogId); err != nil {
+		return nil, err
+	}
+	var rev types.BlogRevision
+	if err := s.db.Where("blog_id = ?", blogId).First(&rev, revisionId).Error; err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+/*
+RestoreBlogRevision makes an old revision the current version of the blog.
+The restore is itself saved as a new revision, so it can be undone the same way
+@params:
+editor - the user asking, who must own the blog unless they can edit any blog
+blogId - the id of the blog
+revisionId - the id of the revision to restore
+*/
+func (s *Store) RestoreBlogRevision(editor types.BlogEditor, blogId, revisionId int64) error {
+	rev, err := s.GetBlogRevisionById(editor, blogId, revisionId)
+	if err != nil {
+		return err
+	}
+
+	tags := make([]types.Tag, 0, len(rev.Tags))
+	for _, name := range rev.Tags {
+		tags = append(tags, types.Tag{Name: name})
+	}
+	b := types.Blog{
+		Title:       rev.Title,
+		Description: rev.Description,
+		Content:     rev.Content,
+		CategoryID:  rev.CategoryID,
+		Tags:        tags,
+	}
+	// the revision's tags are restored as they were, including having none
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return updateBlog(tx, editor, blogId, b, true)
+	})
+}
+
+// uniqueSlug returns a slug for the title that no other blog uses, now or previously.
+// collisions get a numeric suffix: my-post, my-post-2, my-post-3...
+// @params: blogId - the blog the slug is for (0 for new blogs), its own old slugs can be reused
+func uniqueSlug(tx *gorm.DB, blogId int64, title string) (string, error) {
+	base := utils.Slugify(title)
+	if base == "" {
+		base = "post"
+	}
+
+	for n := 1; ; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, n)
+		}
+
+		var taken int64
+		if err := tx.Model(&types.Blog{}).Unscoped().Where("slug = ? AND id <> ?", candidate, blogId).Count(&taken).Error; err != nil {
+			return "", err
+		}
+		if taken > 0 {
+			continue
+		}
+		if err := tx.Model(&types.BlogSlug{}).Where("slug = ? AND blog_id <> ?", candidate, blogId).Count(&taken).Error; err != nil {
+			return "", err
+		}
+		if taken == 0 {
+			return candidate, nil
+		}
+	}
+}
+
+// changeSlug generates the slug for the blog's new title and keeps the current one as a redirect
+func changeSlug(tx *gorm.DB, blogId int64, currentSlug, title string) (string, error) {
+	slug, err := uniqueSlug(tx, blogId, title)
+	if err != nil || slug == currentSlug {
+		return slug, err
+	}
+
+	// the new slug may be one the blog used before, it is no longer a redirect
+	if err := tx.Where("blog_id = ? AND slug = ?", blogId, slug).Delete(&types.BlogSlug{}).Error; err != nil {
+		return "", err
+	}
+	if currentSlug != "" {
+		if err := tx.Create(&types.BlogSlug{BlogID: uint(blogId), Slug: currentSlug}).Error; err != nil {
+			return "", err
+		}
+	}
+	return slug, nil
+}
+
+// RefreshSearchVector rebuilds the full-text search document of the blogs matched by tx.
+// title is weighted above description, category and tags, which are above content
+func RefreshSearchVector(tx *gorm.DB) error {
+	return tx.Model(&types.Blog{}).Unscoped().
+		Update("search_vector", gorm.Expr(`
+			setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+			setweight(to_tsvector('english', coalesce(description, '')), 'B') ||
+			setweight(to_tsvector('english', coalesce((
+				SELECT name FROM categories WHERE categories.id = blogs.category_id), '') || ' ' || coalesce((
+				SELECT string_agg(tags.name, ' ') FROM tags
+				JOIN blog_tags ON blog_tags.tag_id = tags.id
+				WHERE blog_tags.blog_id = blogs.id), '')), 'B') ||
+			setweight(to_tsvector('english', coalesce(content, '')), 'C')`)).Error
+}
+
+// categoryExists checks that blogs can be filed under the category
+func categoryExists(tx *gorm.DB, categoryId uint) error {
+	var count int64
+	if err := tx.Model(&types.Category{}).Where("id = ?", categoryId).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("category not found")
+	}
+	return nil
 }
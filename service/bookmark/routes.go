@@ -0,0 +1,291 @@
+package bookmark
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/config"
+	"github.com/izumii.cxde/blog-api/service/auth"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+)
+
+type Handler struct {
+	store     types.BookmarkStore
+	blogStore types.BlogStore
+}
+
+func NewHandler(store types.BookmarkStore, blogStore types.BlogStore) *Handler {
+	return &Handler{store: store, blogStore: blogStore}
+}
+
+/*
+RegisterRoutes registers the bookmark and reading list routes.
+@params: authMiddleware - authenticates everything but shared reading lists,
+viewerMiddleware - identifies the viewer of a shared reading list
+*/
+func (h *Handler) RegisterRoutes(router *mux.Router, authMiddleware, viewerMiddleware mux.MiddlewareFunc) {
+	public := router.PathPrefix("/").Subrouter()
+	public.HandleFunc("/reading-lists/shared/{token}", h.handleGetSharedReadingList).Methods("GET")
+	public.Use(viewerMiddleware)
+
+	r := router.PathPrefix("/").Subrouter()
+	r.HandleFunc("/bookmarks", h.handleGetBookmarks).Methods("GET")
+	r.HandleFunc("/bookmarks/{blogId:[0-9]+}", h.handleAddBookmark).Methods("POST")
+	r.HandleFunc("/bookmarks/{blogId:[0-9]+}", h.handleRemoveBookmark).Methods("DELETE")
+
+	r.HandleFunc("/reading-lists", h.handleGetReadingLists).Methods("GET")
+	r.HandleFunc("/reading-lists", h.handleReadingListCreation).Methods("POST")
+	r.HandleFunc("/reading-lists/{id:[0-9]+}", h.handleGetReadingList).Methods("GET")
+	r.HandleFunc("/reading-lists/{id:[0-9]+}", h.handleReadingListUpdate).Methods("PATCH")
+	r.HandleFunc("/reading-lists/{id:[0-9]+}", h.handleReadingListDeletion).Methods("DELETE")
+	r.HandleFunc("/reading-lists/{id:[0-9]+}/items", h.handleAddReadingListItem).Methods("POST")
+	r.HandleFunc("/reading-lists/{id:[0-9]+}/items/{blogId:[0-9]+}", h.handleRemoveReadingListItem).Methods("DELETE")
+	r.HandleFunc("/reading-lists/{id:[0-9]+}/order", h.handleReorderReadingList).Methods("PUT")
+
+	r.Use(authMiddleware)
+}
+
+// visibleBlog checks that the blog exists and the user can see it
+func (h *Handler) visibleBlog(r *http.Request, blogId int64) error {
+	b, err := h.blogStore.GetBlogById(blogId)
+	if err != nil || !auth.BlogEditor(r).CanView(b) {
+		return fmt.Errorf("blog not found")
+	}
+	return nil
+}
+
+// prepareReadingList blanks the items the viewer can't see and adds the share url of public lists
+func prepareReadingList(l *types.ReadingList, viewer types.BlogEditor) {
+	MarkUnavailable(l, viewer)
+	if l.Public {
+		l.ShareURL = fmt.Sprintf("%s/api/v1/reading-lists/shared/%s", config.Envs.PublicHost, l.ShareToken)
+	}
+}
+
+func (h *Handler) handleGetBookmarks(w http.ResponseWriter, r *http.Request) {
+	bookmarks, err := h.store.GetBookmarks(auth.BlogEditor(r))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting bookmarks: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, bookmarks)
+}
+
+func (h *Handler) handleAddBookmark(w http.ResponseWriter, r *http.Request) {
+	blogId, err := strconv.ParseInt(mux.Vars(r)["blogId"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	if err := h.visibleBlog(r, blogId); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := h.store.AddBookmark(userId, blogId); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to bookmark blog: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusCreated, map[string]string{"message": "blog bookmarked"})
+}
+
+func (h *Handler) handleRemoveBookmark(w http.ResponseWriter, r *http.Request) {
+	blogId, err := strconv.ParseInt(mux.Vars(r)["blogId"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+
+	if err := h.store.RemoveBookmark(userId, blogId); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("failed to remove bookmark: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "bookmark removed"})
+}
+
+func (h *Handler) handleGetReadingLists(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	lists, err := h.store.GetReadingLists(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting reading lists: %w", err))
+		return
+	}
+	for i := range *lists {
+		prepareReadingList(&(*lists)[i], auth.BlogEditor(r))
+	}
+	utils.WriteJSON(w, http.StatusOK, lists)
+}
+
+// handleGetReadingList returns one of the caller's own reading lists
+func (h *Handler) handleGetReadingList(w http.ResponseWriter, r *http.Request) {
+	listId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid reading list id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+
+	l, err := h.store.GetReadingListById(listId)
+	// other users' lists are only reachable through their share url
+	if err != nil || int64(l.UserID) != userId {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("reading list not found"))
+		return
+	}
+	prepareReadingList(l, auth.BlogEditor(r))
+	utils.WriteJSON(w, http.StatusOK, l)
+}
+
+// handleGetSharedReadingList returns a public reading list by the token in its share url
+func (h *Handler) handleGetSharedReadingList(w http.ResponseWriter, r *http.Request) {
+	l, err := h.store.GetReadingListByShareToken(mux.Vars(r)["token"])
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("reading list not found"))
+		return
+	}
+	prepareReadingList(l, auth.BlogEditor(r))
+	utils.WriteJSON(w, http.StatusOK, l)
+}
+
+func (h *Handler) handleReadingListCreation(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var l types.ReadingList
+	if err := utils.ParseJSON(r, &l); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(l); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	l.UserID = uint(userId)
+
+	created, err := h.store.CreateReadingList(l)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to create reading list: %w", err))
+		return
+	}
+	prepareReadingList(created, auth.BlogEditor(r))
+	utils.WriteJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) handleReadingListUpdate(w http.ResponseWriter, r *http.Request) {
+	listId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid reading list id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var l types.ReadingList
+	if err := utils.ParseJSON(r, &l); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(l); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if err := h.store.UpdateReadingListById(userId, listId, l); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("failed to update reading list: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "reading list updated successfully"})
+}
+
+func (h *Handler) handleReadingListDeletion(w http.ResponseWriter, r *http.Request) {
+	listId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid reading list id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+
+	if err := h.store.DeleteReadingListById(userId, listId); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("failed to delete reading list: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "reading list deleted successfully"})
+}
+
+func (h *Handler) handleAddReadingListItem(w http.ResponseWriter, r *http.Request) {
+	listId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid reading list id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var p struct {
+		BlogID int64 `json:"blog_id" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if err := h.visibleBlog(r, p.BlogID); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := h.store.AddReadingListItem(userId, listId, p.BlogID); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("failed to add blog to reading list: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusCreated, map[string]string{"message": "blog added to reading list"})
+}
+
+func (h *Handler) handleRemoveReadingListItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	listId, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid reading list id: %w", err))
+		return
+	}
+	blogId, err := strconv.ParseInt(vars["blogId"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+
+	if err := h.store.RemoveReadingListItem(userId, listId, blogId); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("failed to remove blog from reading list: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "blog removed from reading list"})
+}
+
+// handleReorderReadingList takes every blog id of the list in the new order: {"blog_ids": [3, 1, 2]}
+func (h *Handler) handleReorderReadingList(w http.ResponseWriter, r *http.Request) {
+	listId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid reading list id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var p struct {
+		BlogIDs []int64 `json:"blog_ids" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if err := h.store.ReorderReadingList(userId, listId, p.BlogIDs); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to reorder reading list: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "reading list reordered"})
+}
@@ -0,0 +1,293 @@
+package bookmark
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Store struct {
+	db *gorm.DB
+}
+
+func NewStore(db *gorm.DB) *Store {
+	return &Store{db: db}
+}
+
+/*
+AddBookmark bookmarks a blog for the user. bookmarking a blog twice is a no-op
+@params: userId - the id of the user, blogId - the id of the blog
+*/
+func (s *Store) AddBookmark(userId, blogId int64) error {
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&types.Bookmark{UserID: uint(userId), BlogID: uint(blogId)}).Error
+}
+
+/*
+RemoveBookmark removes the user's bookmark of a blog
+@params: userId - the id of the user, blogId - the id of the blog
+*/
+func (s *Store) RemoveBookmark(userId, blogId int64) error {
+	res := s.db.Where("user_id = ? AND blog_id = ?", userId, blogId).Delete(&types.Bookmark{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("no bookmark found")
+	}
+	return nil
+}
+
+/*
+GetBookmarks returns the user's bookmarks, newest first.
+bookmarks of blogs that were deleted, or unpublished and can't be seen by the user, are marked as unavailable
+@params: viewer - the user, with whether they can see anyone's drafts
+*/
+func (s *Store) GetBookmarks(viewer types.BlogEditor) (*[]types.Bookmark, error) {
+	var bookmarks []types.Bookmark
+	if err := s.db.Preload("Blog").Preload("Blog.Tags").Preload("Blog.Category").
+		Where("user_id = ?", viewer.UserId).
+		Order("created_at DESC, id DESC").
+		Find(&bookmarks).Error; err != nil {
+		return nil, err
+	}
+	for i := range bookmarks {
+		if !available(bookmarks[i].Blog, viewer) {
+			bookmarks[i].Blog = nil
+			bookmarks[i].Unavailable = true
+		}
+	}
+	return &bookmarks, nil
+}
+
+/*
+CreateReadingList creates a reading list with a share token
+@params: l - the reading list, with UserID set by the caller
+@returns: the created reading list, error
+*/
+func (s *Store) CreateReadingList(l types.ReadingList) (*types.ReadingList, error) {
+	if errs := utils.Validate.Struct(l); errs != nil {
+		return nil, errs.(validator.ValidationErrors)
+	}
+	token, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+	l.ID = 0
+	l.Items = nil
+	l.ShareToken = token
+	if err := s.db.Create(&l).Error; err != nil {
+		return nil, err
+	}
+	l.Items = []types.ReadingListItem{}
+	return &l, nil
+}
+
+/*
+GetReadingLists returns the user's reading lists with their items
+@params: userId - the id of the user
+*/
+func (s *Store) GetReadingLists(userId int64) (*[]types.ReadingList, error) {
+	var lists []types.ReadingList
+	if err := preloadItems(s.db).Where("user_id = ?", userId).Order("created_at ASC").Find(&lists).Error; err != nil {
+		return nil, err
+	}
+	return &lists, nil
+}
+
+/*
+GetReadingListById returns a reading list with its items in order
+@params: id - the id of the reading list
+*/
+func (s *Store) GetReadingListById(id int64) (*types.ReadingList, error) {
+	var l types.ReadingList
+	if err := preloadItems(s.db).First(&l, id).Error; err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+/*
+GetReadingListByShareToken returns a public reading list by its share token.
+private lists are never returned, even with the right token
+@params: token - the share token of the reading list
+*/
+func (s *Store) GetReadingListByShareToken(token string) (*types.ReadingList, error) {
+	var l types.ReadingList
+	if err := preloadItems(s.db).Where("share_token = ? AND public = ?", token, true).First(&l).Error; err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+/*
+UpdateReadingListById updates the name, description and visibility of a reading list
+@params: userId - the id of the owner, id - the id of the reading list, l - the new values
+*/
+func (s *Store) UpdateReadingListById(userId, id int64, l types.ReadingList) error {
+	if errs := utils.Validate.Struct(l); errs != nil {
+		return errs.(validator.ValidationErrors)
+	}
+	res := s.db.Model(&types.ReadingList{}).Where("user_id = ? AND id = ?", userId, id).Updates(map[string]any{
+		"name":        l.Name,
+		"description": l.Description,
+		"public":      l.Public,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("no reading list found")
+	}
+	return nil
+}
+
+/*
+DeleteReadingListById deletes a reading list and its items
+@params: userId - the id of the owner, id - the id of the reading list
+*/
+func (s *Store) DeleteReadingListById(userId, id int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := listOwnedBy(tx, userId, id); err != nil {
+			return err
+		}
+		if err := tx.Where("reading_list_id = ?", id).Delete(&types.ReadingListItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&types.ReadingList{}, id).Error
+	})
+}
+
+/*
+AddReadingListItem appends a blog to the end of a reading list. adding a blog twice is a no-op
+@params: userId - the id of the owner, listId - the id of the reading list, blogId - the id of the blog
+*/
+func (s *Store) AddReadingListItem(userId, listId, blogId int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// the list row is locked so concurrent appends get distinct positions
+		var l types.ReadingList
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userId).First(&l, listId).Error; err != nil {
+			return fmt.Errorf("no reading list found")
+		}
+		var position int
+		if err := tx.Model(&types.ReadingListItem{}).Where("reading_list_id = ?", listId).
+			Select("COALESCE(MAX(position), 0)").Scan(&position).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&types.ReadingListItem{
+			ReadingListID: uint(listId),
+			BlogID:        uint(blogId),
+			Position:      position + 1,
+		}).Error
+	})
+}
+
+/*
+RemoveReadingListItem removes a blog from a reading list
+@params: userId - the id of the owner, listId - the id of the reading list, blogId - the id of the blog
+*/
+func (s *Store) RemoveReadingListItem(userId, listId, blogId int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := listOwnedBy(tx, userId, listId); err != nil {
+			return err
+		}
+		res := tx.Where("reading_list_id = ? AND blog_id = ?", listId, blogId).Delete(&types.ReadingListItem{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("blog is not in the reading list")
+		}
+		return nil
+	})
+}
+
+/*
+ReorderReadingList puts the items of a reading list in the given order.
+blogIds must contain every blog in the list exactly once
+@params: userId - the id of the owner, listId - the id of the reading list, blogIds - the blogs in their new order
+*/
+func (s *Store) ReorderReadingList(userId, listId int64, blogIds []int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var l types.ReadingList
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userId).First(&l, listId).Error; err != nil {
+			return fmt.Errorf("no reading list found")
+		}
+
+		var current []int64
+		if err := tx.Model(&types.ReadingListItem{}).Where("reading_list_id = ?", listId).Pluck("blog_id", &current).Error; err != nil {
+			return err
+		}
+		inList := make(map[int64]bool, len(current))
+		for _, id := range current {
+			inList[id] = true
+		}
+		if len(blogIds) != len(current) {
+			return fmt.Errorf("the new order must contain every blog in the reading list")
+		}
+		for _, id := range blogIds {
+			if !inList[id] {
+				return fmt.Errorf("the new order must contain every blog in the reading list")
+			}
+			// each blog only once
+			delete(inList, id)
+		}
+
+		for i, id := range blogIds {
+			if err := tx.Model(&types.ReadingListItem{}).
+				Where("reading_list_id = ? AND blog_id = ?", listId, id).
+				Update("position", i+1).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MarkUnavailable blanks the items of the list that the viewer can no longer see
+func MarkUnavailable(l *types.ReadingList, viewer types.BlogEditor) {
+	for i := range l.Items {
+		if !available(l.Items[i].Blog, viewer) {
+			l.Items[i].Blog = nil
+			l.Items[i].Unavailable = true
+		}
+	}
+}
+
+// available reports whether a bookmarked blog can still be shown to the viewer.
+// soft deleted blogs aren't preloaded at all, unpublished ones are only visible to their author and editors
+func available(b *types.Blog, viewer types.BlogEditor) bool {
+	return b != nil && viewer.CanView(b)
+}
+
+func preloadItems(db *gorm.DB) *gorm.DB {
+	return db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Order("position ASC, id ASC")
+	}).Preload("Items.Blog").Preload("Items.Blog.Tags").Preload("Items.Blog.Category")
+}
+
+func listOwnedBy(tx *gorm.DB, userId, listId int64) error {
+	var count int64
+	if err := tx.Model(&types.ReadingList{}).Where("user_id = ? AND id = ?", userId, listId).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no reading list found")
+	}
+	return nil
+}
+
+// newShareToken generates the unguessable token used in the share url of a reading list
+func newShareToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
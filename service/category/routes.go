@@ -0,0 +1,102 @@
+package category
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/service/auth"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+)
+
+type Handler struct {
+	store types.CategoryStore
+}
+
+func NewHandler(store types.CategoryStore) *Handler {
+	return &Handler{store: store}
+}
+
+/*
+RegisterRoutes registers the category routes.
+@params: authMiddleware - authenticates the management routes
+*/
+func (h *Handler) RegisterRoutes(router *mux.Router, authMiddleware mux.MiddlewareFunc) {
+	public := router.PathPrefix("/").Subrouter()
+	public.HandleFunc("/categories", h.handleGetAllCategories).Methods("GET")
+	public.HandleFunc("/categories/{slug}", h.handleGetCategory).Methods("GET")
+
+	// managing categories needs the taxonomy permission (editors and admins)
+	r := router.PathPrefix("/").Subrouter()
+	r.Handle("/categories", auth.Allow(types.PermissionManageTaxonomy, h.handleCategoryCreation)).Methods("POST")
+	r.Handle("/categories/{slug}", auth.Allow(types.PermissionManageTaxonomy, h.handleCategoryUpdate)).Methods("PATCH")
+	r.Handle("/categories/{slug}", auth.Allow(types.PermissionManageTaxonomy, h.handleCategoryDeletion)).Methods("DELETE")
+
+	r.Use(authMiddleware)
+}
+
+func (h *Handler) handleGetAllCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := h.store.GetAllCategories()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting categories: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, categories)
+}
+
+func (h *Handler) handleGetCategory(w http.ResponseWriter, r *http.Request) {
+	c, err := h.store.GetCategoryBySlug(mux.Vars(r)["slug"])
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("category not found"))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, c)
+}
+
+func (h *Handler) handleCategoryCreation(w http.ResponseWriter, r *http.Request) {
+	var c types.Category
+	if err := utils.ParseJSON(r, &c); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(c); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	created, err := h.store.CreateCategory(c)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to create category: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) handleCategoryUpdate(w http.ResponseWriter, r *http.Request) {
+	var c types.Category
+	fields, err := utils.ParseJSONFields(r, &c)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	// only the fields that were sent are validated and changed, "parent_id": null moves the category to the top level
+	if err := validateFields(c, fields); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if err := h.store.UpdateCategoryBySlug(mux.Vars(r)["slug"], c, fields); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to update category: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "category updated successfully"})
+}
+
+func (h *Handler) handleCategoryDeletion(w http.ResponseWriter, r *http.Request) {
+	if err := h.store.DeleteCategoryBySlug(mux.Vars(r)["slug"]); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to delete category: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "category deleted successfully"})
+}
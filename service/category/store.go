@@ -0,0 +1,266 @@
+package category
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/izumii.cxde/blog-api/service/blog"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+	"gorm.io/gorm"
+)
+
+type Store struct {
+	db *gorm.DB
+}
+
+func NewStore(db *gorm.DB) *Store {
+	return &Store{db: db}
+}
+
+/*
+GetAllCategories returns every category as a tree. top level categories are
+returned with their descendants nested under Children
+*/
+func (s *Store) GetAllCategories() (*[]types.Category, error) {
+	var categories []types.Category
+	if err := s.db.Order("name ASC").Find(&categories).Error; err != nil {
+		return nil, err
+	}
+
+	// group by parent, then build the tree from the top level down
+	children := map[uint][]types.Category{}
+	var roots []types.Category
+	for _, c := range categories {
+		if c.ParentID == nil {
+			roots = append(roots, c)
+		} else {
+			children[*c.ParentID] = append(children[*c.ParentID], c)
+		}
+	}
+	var attach func(cs []types.Category) []types.Category
+	attach = func(cs []types.Category) []types.Category {
+		for i := range cs {
+			cs[i].Children = attach(children[cs[i].ID])
+		}
+		return cs
+	}
+	roots = attach(roots)
+	if roots == nil {
+		roots = []types.Category{}
+	}
+	return &roots, nil
+}
+
+/*
+GetCategoryBySlug returns a category with its direct children
+@params: slug - the slug of the category
+*/
+func (s *Store) GetCategoryBySlug(slug string) (*types.Category, error) {
+	var c types.Category
+	if err := s.db.Preload("Children").Where("slug = ?", slug).First(&c).Error; err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+/*
+CreateCategory creates a category. the slug is generated from the name unless one is given
+@params: c - the category to create
+@returns: the created category, error
+*/
+func (s *Store) CreateCategory(c types.Category) (*types.Category, error) {
+	if errs := utils.Validate.Struct(c); errs != nil {
+		return nil, errs.(validator.ValidationErrors)
+	}
+	c.ID = 0
+	c.Children = nil
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if c.ParentID != nil {
+			if err := tx.First(&types.Category{}, *c.ParentID).Error; err != nil {
+				return fmt.Errorf("parent category not found")
+			}
+		}
+		slug, err := uniqueSlug(tx, 0, c.Slug, c.Name)
+		if err != nil {
+			return err
+		}
+		c.Slug = slug
+		return tx.Create(&c).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// the fields of a category that can be updated, by their json name
+var updatableFields = map[string]string{
+	"name":        "Name",
+	"slug":        "Slug",
+	"description": "Description",
+	"parent_id":   "ParentID",
+}
+
+// validateFields validates the fields of c that were sent, as returned by utils.ParseJSONFields
+func validateFields(c types.Category, fields map[string]json.RawMessage) error {
+	var names []string
+	for key := range fields {
+		if field, ok := updatableFields[key]; ok {
+			names = append(names, field)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("nothing to update")
+	}
+	if errs := utils.Validate.StructPartial(c, names...); errs != nil {
+		return errs.(validator.ValidationErrors)
+	}
+	return nil
+}
+
+/*
+UpdateCategoryBySlug updates the name, slug, description and parent of a category. only the fields
+that were sent change. a category can't be moved under itself or one of its descendants
+@params: slug - the slug of the category, c - the new values,
+fields - the fields of the request body, from utils.ParseJSONFields
+*/
+func (s *Store) UpdateCategoryBySlug(slug string, c types.Category, fields map[string]json.RawMessage) error {
+	if err := validateFields(c, fields); err != nil {
+		return err
+	}
+	_, setName := fields["name"]
+	_, setSlug := fields["slug"]
+	_, setDescription := fields["description"]
+	_, setParent := fields["parent_id"]
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var current types.Category
+		if err := tx.Where("slug = ?", slug).First(&current).Error; err != nil {
+			return err
+		}
+
+		if setParent && c.ParentID != nil {
+			descendant, err := isDescendant(tx, *c.ParentID, current.ID)
+			if err != nil {
+				return err
+			}
+			if descendant {
+				return fmt.Errorf("a category can't be nested under itself")
+			}
+		}
+
+		values := map[string]any{}
+		if setName {
+			values["name"] = c.Name
+		}
+		if setDescription {
+			values["description"] = c.Description
+		}
+		if setParent {
+			values["parent_id"] = c.ParentID
+		}
+		// an empty slug keeps the current one
+		if setSlug && c.Slug != "" && utils.Slugify(c.Slug) != current.Slug {
+			name := current.Name
+			if setName {
+				name = c.Name
+			}
+			newSlug, err := uniqueSlug(tx, current.ID, c.Slug, name)
+			if err != nil {
+				return err
+			}
+			values["slug"] = newSlug
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		if err := tx.Model(&current).Updates(values).Error; err != nil {
+			return err
+		}
+		if !setName {
+			return nil
+		}
+		// the category name is part of the search document of its blogs
+		return blog.RefreshSearchVector(tx.Where("category_id = ?", current.ID))
+	})
+}
+
+/*
+DeleteCategoryBySlug deletes a category. categories that still have blogs or
+child categories can't be deleted, they have to be moved first
+@params: slug - the slug of the category
+*/
+func (s *Store) DeleteCategoryBySlug(slug string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var c types.Category
+		if err := tx.Where("slug = ?", slug).First(&c).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&types.Category{}).Where("parent_id = ?", c.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("category has child categories")
+		}
+		// soft deleted blogs still reference the category
+		if err := tx.Model(&types.Blog{}).Unscoped().Where("category_id = ?", c.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("category has blogs")
+		}
+		return tx.Delete(&c).Error
+	})
+}
+
+// isDescendant reports whether id is the category ancestorId or nested anywhere below it
+func isDescendant(tx *gorm.DB, id, ancestorId uint) (bool, error) {
+	for {
+		if id == ancestorId {
+			return true, nil
+		}
+		var c types.Category
+		err := tx.Select("id", "parent_id").First(&c, id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, fmt.Errorf("parent category not found")
+		}
+		if err != nil {
+			return false, err
+		}
+		if c.ParentID == nil {
+			return false, nil
+		}
+		id = *c.ParentID
+	}
+}
+
+// uniqueSlug returns a slug, taken from slug or else from name, that no other category uses
+func uniqueSlug(tx *gorm.DB, categoryId uint, slug, name string) (string, error) {
+	base := utils.Slugify(slug)
+	if base == "" {
+		base = utils.Slugify(name)
+	}
+	if base == "" {
+		base = "category"
+	}
+
+	for n := 1; ; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, n)
+		}
+		var taken int64
+		if err := tx.Model(&types.Category{}).Where("slug = ? AND id <> ?", candidate, categoryId).Count(&taken).Error; err != nil {
+			return "", err
+		}
+		if taken == 0 {
+			return candidate, nil
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package comment
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/service/auth"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+)
+
+type Handler struct {
+	store     types.CommentStore
+	blogStore types.BlogStore
+	userStore types.UserStore
+}
+
+func NewHandler(store types.CommentStore, blogStore types.BlogStore, userStore types.UserStore) *Handler {
+	return &Handler{store: store, blogStore: blogStore, userStore: userStore}
+}
+
+/*
+RegisterRoutes registers the comment routes.
+@params: authMiddleware - authenticates everything but reading comments,
+viewerMiddleware - identifies the viewer when reading comments
+*/
+func (h *Handler) RegisterRoutes(router *mux.Router, authMiddleware, viewerMiddleware mux.MiddlewareFunc) {
+	public := router.PathPrefix("/").Subrouter()
+	public.HandleFunc("/blogs/{id}/comments", h.handleGetComments).Methods("GET")
+	public.Use(viewerMiddleware)
+
+	r := router.PathPrefix("/").Subrouter()
+	r.HandleFunc("/blogs/{id}/comments", h.handleCommentCreation).Methods("POST")
+	r.HandleFunc("/comments/{commentId}", h.handleCommentUpdate).Methods("PATCH")
+	r.HandleFunc("/comments/{commentId}", h.handleCommentDeletion).Methods("DELETE")
+
+	// only the author of the blog can lock its comments
+	r.HandleFunc("/blogs/{id}/comments/lock", h.handleCommentsLock(true)).Methods("POST")
+	r.HandleFunc("/blogs/{id}/comments/unlock", h.handleCommentsLock(false)).Methods("POST")
+
+	r.Use(authMiddleware)
+}
+
+// visibleBlog returns the blog if the viewer is allowed to see it. unpublished blogs are only visible to their author and editors
+func (h *Handler) visibleBlog(r *http.Request) (*types.Blog, error) {
+	blogId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blog id: %w", err)
+	}
+	b, err := h.blogStore.GetBlogById(blogId)
+	if err != nil || !auth.BlogEditor(r).CanView(b) {
+		return nil, fmt.Errorf("blog not found")
+	}
+	return b, nil
+}
+
+// handleGetComments returns a page of comment threads: ?sort=oldest|score &limit= (max 100) &offset=
+func (h *Handler) handleGetComments(w http.ResponseWriter, r *http.Request) {
+	b, err := h.visibleBlog(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	query := r.URL.Query()
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = types.CommentSortOldest
+	}
+	if sort != types.CommentSortOldest && sort != types.CommentSortScore {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid sort order: %s", sort))
+		return
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	comments, err := h.store.GetCommentsByBlogId(int64(b.ID), sort, limit, offset)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting comments: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, comments)
+}
+
+func (h *Handler) handleCommentCreation(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	// only verified users can comment
+	u, err := h.userStore.GetUserById(userId)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !u.Verified {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("please verify your email before commenting"))
+		return
+	}
+
+	b, err := h.visibleBlog(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+	if b.CommentsLocked {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("comments are locked on this blog"))
+		return
+	}
+
+	var c types.Comment
+	if err := utils.ParseJSON(r, &c); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(c); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	// only the body and parent come from the request
+	comment := types.Comment{
+		BlogID:   b.ID,
+		UserID:   uint(userId),
+		ParentID: c.ParentID,
+		Body:     c.Body,
+	}
+
+	created, err := h.store.CreateComment(comment)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to create comment: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) handleCommentUpdate(w http.ResponseWriter, r *http.Request) {
+	commentId, err := strconv.ParseInt(mux.Vars(r)["commentId"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid comment id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+
+	var p struct {
+		Body string `json:"body" validate:"required,min=1,max=2000"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	c, err := h.store.GetCommentById(commentId)
+	if err != nil || int64(c.UserID) != userId {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("comment not found"))
+		return
+	}
+	b, err := h.blogStore.GetBlogById(int64(c.BlogID))
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("blog not found"))
+		return
+	}
+	if b.CommentsLocked {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("comments are locked on this blog"))
+		return
+	}
+
+	if err := h.store.UpdateCommentById(userId, commentId, p.Body); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update comment: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "comment updated successfully"})
+}
+
+// handleCommentDeletion soft deletes a comment. the author of the comment or of the blog can delete it
+func (h *Handler) handleCommentDeletion(w http.ResponseWriter, r *http.Request) {
+	commentId, err := strconv.ParseInt(mux.Vars(r)["commentId"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid comment id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+
+	c, err := h.store.GetCommentById(commentId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("comment not found"))
+		return
+	}
+	if int64(c.UserID) != userId {
+		b, err := h.blogStore.GetBlogById(int64(c.BlogID))
+		if err != nil || int64(b.UserId) != userId {
+			utils.WriteError(w, http.StatusNotFound, fmt.Errorf("comment not found"))
+			return
+		}
+	}
+
+	if err := h.store.SoftDeleteCommentById(commentId); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to delete comment: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "comment deleted successfully"})
+}
+
+func (h *Handler) handleCommentsLock(locked bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		blogId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+			return
+		}
+		userId := r.Context().Value(types.UserIDKey).(int64)
+
+		if err := h.blogStore.SetBlogCommentsLocked(userId, blogId, locked); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update comments: %w", err))
+			return
+		}
+		message := "comments unlocked"
+		if locked {
+			message = "comments locked"
+		}
+		utils.WriteJSON(w, http.StatusOK, map[string]string{"message": message})
+	}
+}
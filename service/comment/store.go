@@ -0,0 +1,180 @@
+package comment
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+	"gorm.io/gorm"
+)
+
+type Store struct {
+	db *gorm.DB
+}
+
+func NewStore(db *gorm.DB) *Store {
+	return &Store{db: db}
+}
+
+/*
+CreateComment creates a comment, or a reply when ParentID is set.
+the parent must be on the same blog
+@params: c - the comment, with BlogID and UserID set by the caller
+@returns: the created comment, error
+*/
+func (s *Store) CreateComment(c types.Comment) (*types.Comment, error) {
+	if errs := utils.Validate.Struct(c); errs != nil {
+		return nil, errs.(validator.ValidationErrors)
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if c.ParentID != nil {
+			// replies to deleted comments are allowed, the thread is still there
+			var parent types.Comment
+			if err := tx.Unscoped().Where("blog_id = ?", c.BlogID).First(&parent, *c.ParentID).Error; err != nil {
+				return fmt.Errorf("parent comment not found")
+			}
+			c.ThreadID = parent.ThreadID
+		}
+		if err := tx.Create(&c).Error; err != nil {
+			return err
+		}
+		// a top level comment starts its own thread
+		if c.ParentID == nil {
+			c.ThreadID = c.ID
+			return tx.Model(&c).Update("thread_id", c.ID).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetCommentById returns a comment that hasn't been deleted
+func (s *Store) GetCommentById(id int64) (*types.Comment, error) {
+	var c types.Comment
+	if err := s.db.First(&c, id).Error; err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+/*
+GetCommentsByBlogId returns a page of the top level comments of a blog, each with all of its replies.
+replies are always oldest first. deleted comments are kept as empty placeholders while
+they still have replies, so the thread stays intact
+@params:
+blogId - the id of the blog
+sort - the order of the top level comments, oldest first or highest score first
+limit, offset - the page of top level comments
+*/
+func (s *Store) GetCommentsByBlogId(blogId int64, sort string, limit, offset int) (*types.CommentPage, error) {
+	order := "created_at ASC, id ASC"
+	if sort == types.CommentSortScore {
+		order = "score DESC, id ASC"
+	}
+
+	// top level comments, deleted ones only while something in their thread is left
+	roots := s.db.Unscoped().Model(&types.Comment{}).
+		Where("blog_id = ? AND parent_id IS NULL", blogId).
+		Where(`(deleted_at IS NULL OR EXISTS (
+			SELECT 1 FROM comments t WHERE t.thread_id = comments.id AND t.deleted_at IS NULL))`).
+		Session(&gorm.Session{}) // reused for the count and the page
+
+	page := types.CommentPage{Data: []types.Comment{}}
+	if err := roots.Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+	var top []types.Comment
+	if err := roots.Order(order).Limit(limit).Offset(offset).Find(&top).Error; err != nil {
+		return nil, err
+	}
+	if len(top) == 0 {
+		return &page, nil
+	}
+
+	threadIds := make([]uint, 0, len(top))
+	for _, c := range top {
+		threadIds = append(threadIds, c.ID)
+	}
+	var replies []types.Comment
+	if err := s.db.Unscoped().
+		Where("thread_id IN ? AND parent_id IS NOT NULL", threadIds).
+		Order("created_at ASC, id ASC").
+		Find(&replies).Error; err != nil {
+		return nil, err
+	}
+
+	children := map[uint][]types.Comment{}
+	for _, c := range replies {
+		children[*c.ParentID] = append(children[*c.ParentID], c)
+	}
+	for _, c := range top {
+		if c, ok := buildThread(c, children); ok {
+			page.Data = append(page.Data, c)
+		}
+	}
+	return &page, nil
+}
+
+// buildThread attaches the replies below c. deleted comments are blanked out,
+// and dropped entirely once nothing below them is left
+func buildThread(c types.Comment, children map[uint][]types.Comment) (types.Comment, bool) {
+	c.Replies = []types.Comment{}
+	for _, reply := range children[c.ID] {
+		if reply, ok := buildThread(reply, children); ok {
+			c.Replies = append(c.Replies, reply)
+		}
+	}
+
+	if c.DeletedAt.Valid {
+		if len(c.Replies) == 0 {
+			return c, false
+		}
+		c.Deleted = true
+		c.Body = ""
+		c.UserID = 0
+	}
+	return c, true
+}
+
+/*
+UpdateCommentById changes the body of a comment and marks it as edited
+@params:
+userId - the id of the user, who must have written the comment
+id - the id of the comment
+body - the new body
+*/
+func (s *Store) UpdateCommentById(userId, id int64, body string) error {
+	res := s.db.Model(&types.Comment{}).Where("user_id = ? AND id = ?", userId, id).Updates(map[string]any{
+		"body":      body,
+		"edited":    true,
+		"edited_at": time.Now(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("no comment found")
+	}
+	return nil
+}
+
+/*
+SoftDeleteCommentById soft deletes a comment. its replies stay in the thread
+@params: id - the id of the comment
+*/
+func (s *Store) SoftDeleteCommentById(id int64) error {
+	res := s.db.Delete(&types.Comment{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("no comment found")
+	}
+	return nil
+}
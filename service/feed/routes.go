@@ -0,0 +1,209 @@
+package feed
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/config"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+)
+
+// number of posts in a feed
+const feedSize = 50
+
+type Handler struct {
+	blogStore     types.BlogStore
+	userStore     types.UserStore
+	categoryStore types.CategoryStore
+}
+
+func NewHandler(blogStore types.BlogStore, userStore types.UserStore, categoryStore types.CategoryStore) *Handler {
+	return &Handler{blogStore: blogStore, userStore: userStore, categoryStore: categoryStore}
+}
+
+/*
+RegisterRoutes registers the public feeds. every feed is served as rss, atom or json feed
+depending on its extension.
+@params: router - the root router, feeds live outside of /api/v1 so readers can find them
+*/
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	const format = "/feed.{format:rss|atom|json}"
+	public := router.PathPrefix("/").Subrouter()
+	public.HandleFunc(format, h.handleFeed).Methods("GET", "HEAD")
+	public.HandleFunc("/authors/{id:[0-9]+}"+format, h.handleAuthorFeed).Methods("GET", "HEAD")
+	public.HandleFunc("/tags/{name}"+format, h.handleTagFeed).Methods("GET", "HEAD")
+	public.HandleFunc("/categories/{slug}"+format, h.handleCategoryFeed).Methods("GET", "HEAD")
+}
+
+func (h *Handler) handleFeed(w http.ResponseWriter, r *http.Request) {
+	h.writeFeed(w, r, Feed{
+		Title:       "Go-Blog",
+		Description: "Latest posts",
+		Link:        config.Envs.PublicHost + "/api/v1/blogs",
+	}, types.BlogListOptions{})
+}
+
+func (h *Handler) handleAuthorFeed(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid author id: %w", err))
+		return
+	}
+	u, err := h.userStore.GetUserById(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("author not found"))
+		return
+	}
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	h.writeFeed(w, r, Feed{
+		Title:       "Go-Blog: " + name,
+		Description: "Latest posts by " + name,
+		Link:        fmt.Sprintf("%s/api/v1/blogs?author=%d", config.Envs.PublicHost, id),
+	}, types.BlogListOptions{AuthorId: id})
+}
+
+func (h *Handler) handleTagFeed(w http.ResponseWriter, r *http.Request) {
+	name := utils.NormalizeTag(mux.Vars(r)["name"])
+	if name == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid tag"))
+		return
+	}
+	h.writeFeed(w, r, Feed{
+		Title:       "Go-Blog: " + name,
+		Description: "Latest posts tagged " + name,
+		Link:        fmt.Sprintf("%s/api/v1/tags/%s/blogs", config.Envs.PublicHost, url.PathEscape(name)),
+	}, types.BlogListOptions{Tag: name})
+}
+
+func (h *Handler) handleCategoryFeed(w http.ResponseWriter, r *http.Request) {
+	c, err := h.categoryStore.GetCategoryBySlug(mux.Vars(r)["slug"])
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("category not found"))
+		return
+	}
+	h.writeFeed(w, r, Feed{
+		Title:       "Go-Blog: " + c.Name,
+		Description: c.Description,
+		Link:        fmt.Sprintf("%s/api/v1/categories/%s/blogs", config.Envs.PublicHost, c.Slug),
+	}, types.BlogListOptions{Category: c.Slug})
+}
+
+/*
+writeFeed fills the feed with the latest published blogs matching opts and writes it in the
+requested format. responds with 304 when the client's copy is still current
+*/
+func (h *Handler) writeFeed(w http.ResponseWriter, r *http.Request, f Feed, opts types.BlogListOptions) {
+	opts.Limit = feedSize
+	opts.Sort = types.BlogSortPublished
+	// viewer 0 only ever sees published blogs
+	page, err := h.blogStore.GetAllBlogs(0, opts)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting blogs: %w", err))
+		return
+	}
+
+	format := mux.Vars(r)["format"]
+	f.FeedURL = config.Envs.PublicHost + r.URL.Path
+	f.Items = h.items(page.Data)
+	for _, item := range f.Items {
+		if item.Updated.After(f.Updated) {
+			f.Updated = item.Updated
+		}
+	}
+
+	etag := feedETag(format, f)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	// no Last-Modified: a post leaving the feed changes it without any remaining item being newer
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var body []byte
+	switch format {
+	case "rss":
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		body, err = f.RSS()
+	case "atom":
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		body, err = f.Atom()
+	default:
+		w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+		body, err = json.Marshal(f.JSON())
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error rendering feed: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// items turns blogs into feed items, looking up every author once
+func (h *Handler) items(blogs []types.Blog) []Item {
+	authors := map[uint]string{}
+	items := make([]Item, 0, len(blogs))
+	for _, b := range blogs {
+		name, ok := authors[b.UserId]
+		if !ok {
+			if u, err := h.userStore.GetUserById(int64(b.UserId)); err == nil {
+				name = strings.TrimSpace(u.FirstName + " " + u.LastName)
+			}
+			authors[b.UserId] = name
+		}
+
+		published := b.CreatedAt
+		if b.PublishedAt != nil {
+			published = *b.PublishedAt
+		}
+		tags := make([]string, 0, len(b.Tags))
+		for _, t := range b.Tags {
+			tags = append(tags, t.Name)
+		}
+		items = append(items, Item{
+			GUID:        itemGUID(b),
+			Title:       b.Title,
+			Link:        fmt.Sprintf("%s/api/v1/posts/%s", config.Envs.PublicHost, b.Slug),
+			Summary:     b.Description,
+			ContentHTML: b.ContentHTML,
+			Author:      name,
+			Tags:        tags,
+			Published:   published,
+			Updated:     b.UpdatedAt,
+		})
+	}
+	return items
+}
+
+// feedETag hashes everything that ends up in the feed, so any change to it, edits included, gives a new etag
+func feedETag(format string, f Feed) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s\n", format, f.Title, f.Description)
+	for _, item := range f.Items {
+		fmt.Fprintf(hash, "%s %d %q %q %q %q %q %q\n", item.GUID, item.Updated.UnixNano(),
+			item.Title, item.Link, item.Summary, item.ContentHTML, item.Author, item.Tags)
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// notModified reports whether the client's cached copy, named by If-None-Match, is current
+func notModified(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package reaction
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/service/auth"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+)
+
+type Handler struct {
+	store        types.ReactionStore
+	blogStore    types.BlogStore
+	commentStore types.CommentStore
+}
+
+func NewHandler(store types.ReactionStore, blogStore types.BlogStore, commentStore types.CommentStore) *Handler {
+	return &Handler{store: store, blogStore: blogStore, commentStore: commentStore}
+}
+
+/*
+RegisterRoutes registers the reaction routes.
+@params: authMiddleware - authenticates every reaction route
+*/
+func (h *Handler) RegisterRoutes(router *mux.Router, authMiddleware mux.MiddlewareFunc) {
+	r := router.PathPrefix("/").Subrouter()
+	r.HandleFunc("/blogs/{id}/reactions", h.handleBlogReaction).Methods("POST")
+	r.HandleFunc("/comments/{commentId}/reactions", h.handleCommentReaction).Methods("POST")
+
+	r.Use(authMiddleware)
+}
+
+type reactionPayload struct {
+	Type types.ReactionType `json:"type" validate:"required,oneof=like love insightful celebrate curious"`
+}
+
+func parseReaction(r *http.Request) (types.ReactionType, error) {
+	var p reactionPayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		return "", err
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		return "", fmt.Errorf("invalid request body: %w", err)
+	}
+	return p.Type, nil
+}
+
+// visibleBlog checks that the blog exists and the user can see it. unpublished blogs are only visible to their author and editors
+func (h *Handler) visibleBlog(r *http.Request, blogId int64) error {
+	b, err := h.blogStore.GetBlogById(blogId)
+	if err != nil || !auth.BlogEditor(r).CanView(b) {
+		return fmt.Errorf("blog not found")
+	}
+	return nil
+}
+
+// handleBlogReaction toggles the caller's reaction on a blog and returns the new counts
+func (h *Handler) handleBlogReaction(w http.ResponseWriter, r *http.Request) {
+	blogId, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid blog id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	t, err := parseReaction(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.visibleBlog(r, blogId); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	summary, err := h.store.ToggleReaction(types.ReactionTargetBlog, blogId, userId, t)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to react: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, summary)
+}
+
+// handleCommentReaction toggles the caller's reaction on a comment and returns the new counts
+func (h *Handler) handleCommentReaction(w http.ResponseWriter, r *http.Request) {
+	commentId, err := strconv.ParseInt(mux.Vars(r)["commentId"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid comment id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	t, err := parseReaction(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// comments can only be reacted to where their blog can be seen
+	c, err := h.commentStore.GetCommentById(commentId)
+	if err != nil || h.visibleBlog(r, int64(c.BlogID)) != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("comment not found"))
+		return
+	}
+
+	summary, err := h.store.ToggleReaction(types.ReactionTargetComment, commentId, userId, t)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to react: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, summary)
+}
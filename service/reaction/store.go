@@ -0,0 +1,137 @@
+package reaction
+
+import (
+	"errors"
+
+	"github.com/izumii.cxde/blog-api/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errConcurrentReaction means another request created the same reaction row first
+var errConcurrentReaction = errors.New("reaction changed concurrently, please retry")
+
+type Store struct {
+	db *gorm.DB
+}
+
+func NewStore(db *gorm.DB) *Store {
+	return &Store{db: db}
+}
+
+/*
+ToggleReaction adds the user's reaction to a target. reacting with the same type
+again removes it, and reacting with another type replaces it.
+the counts are changed in the same transaction as the reaction row, so they stay consistent
+@params:
+target - what is reacted to, a blog or a comment
+targetId - the id of the blog or comment
+userId - the id of the reacting user
+t - the reaction type
+@returns: the updated summary for the target, error
+*/
+func (s *Store) ToggleReaction(target string, targetId, userId int64, t types.ReactionType) (*types.ReactionSummary, error) {
+	// a lost race on creating the row is retried, by then the row exists and can be locked
+	err := errConcurrentReaction
+	for attempt := 0; attempt < 3 && errors.Is(err, errConcurrentReaction); attempt++ {
+		err = s.toggle(target, targetId, userId, t)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	summaries, err := s.GetReactionSummaries(target, []uint{uint(targetId)}, userId)
+	if err != nil {
+		return nil, err
+	}
+	return summaries[uint(targetId)], nil
+}
+
+func (s *Store) toggle(target string, targetId, userId int64, t types.ReactionType) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// the user's reaction row is locked so concurrent toggles are applied one after the other
+		var existing types.Reaction
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("target_type = ? AND target_id = ? AND user_id = ?", target, targetId, userId).
+			First(&existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			r := types.Reaction{TargetType: target, TargetID: uint(targetId), UserID: uint(userId), Type: t}
+			res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&r)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return errConcurrentReaction
+			}
+			return changeCount(tx, target, targetId, t, 1)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := changeCount(tx, target, targetId, existing.Type, -1); err != nil {
+			return err
+		}
+		if existing.Type == t {
+			return tx.Delete(&existing).Error
+		}
+		if err := tx.Model(&existing).Update("type", t).Error; err != nil {
+			return err
+		}
+		return changeCount(tx, target, targetId, t, 1)
+	})
+}
+
+/*
+GetReactionSummaries returns the reaction counts of every target, along with the viewer's own reaction
+@params:
+target - a blog or a comment
+targetIds - the ids of the blogs or comments
+viewerId - the id of the requesting user, 0 for anonymous requests
+@returns: the summaries by target id. every requested id has one, even without reactions
+*/
+func (s *Store) GetReactionSummaries(target string, targetIds []uint, viewerId int64) (map[uint]*types.ReactionSummary, error) {
+	summaries := make(map[uint]*types.ReactionSummary, len(targetIds))
+	for _, id := range targetIds {
+		summaries[id] = &types.ReactionSummary{Counts: map[types.ReactionType]int64{}}
+	}
+	if len(targetIds) == 0 {
+		return summaries, nil
+	}
+
+	var counts []types.ReactionCount
+	if err := s.db.Where("target_type = ? AND target_id IN ? AND count > 0", target, targetIds).Find(&counts).Error; err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		summaries[c.TargetID].Counts[c.Type] = c.Count
+	}
+
+	if viewerId != 0 {
+		var mine []types.Reaction
+		if err := s.db.Where("target_type = ? AND target_id IN ? AND user_id = ?", target, targetIds, viewerId).Find(&mine).Error; err != nil {
+			return nil, err
+		}
+		for _, r := range mine {
+			summaries[r.TargetID].Mine = r.Type
+		}
+	}
+	return summaries, nil
+}
+
+// changeCount atomically adds delta to the count of a reaction type on a target.
+// comment scores follow the total number of reactions on the comment
+func changeCount(tx *gorm.DB, target string, targetId int64, t types.ReactionType, delta int64) error {
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "target_type"}, {Name: "target_id"}, {Name: "type"}},
+		DoUpdates: clause.Assignments(map[string]any{"count": gorm.Expr("reaction_counts.count + ?", delta)}),
+	}).Create(&types.ReactionCount{TargetType: target, TargetID: uint(targetId), Type: t, Count: delta}).Error
+	if err != nil {
+		return err
+	}
+
+	if target == types.ReactionTargetComment {
+		return tx.Model(&types.Comment{}).Where("id = ?", targetId).Update("score", gorm.Expr("score + ?", delta)).Error
+	}
+	return nil
+}
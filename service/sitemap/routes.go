@@ -0,0 +1,232 @@
+package sitemap
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/config"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+)
+
+const (
+	// the sitemap protocol allows at most 50,000 urls per file
+	maxURLs = 50000
+	// the cache is also rebuilt after this long, to pick up user, tag and category changes
+	cacheTTL = time.Hour
+)
+
+type Handler struct {
+	store types.SitemapStore
+
+	mu      sync.Mutex
+	builtAt time.Time
+	pages   [][]byte // pages[0] is /sitemap.xml, either the only urlset or the sitemap index
+	robots  []byte
+}
+
+func NewHandler(store types.SitemapStore) *Handler {
+	return &Handler{store: store}
+}
+
+/*
+RegisterRoutes registers the sitemap and robots.txt.
+@params: router - the root router, crawlers only look for these at the root of the host
+*/
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	public := router.PathPrefix("/").Subrouter()
+	public.HandleFunc("/robots.txt", h.handleRobots).Methods("GET", "HEAD")
+	public.HandleFunc("/sitemap.xml", h.handleSitemap).Methods("GET", "HEAD")
+	public.HandleFunc("/sitemap-{page:[0-9]+}.xml", h.handleSitemap).Methods("GET", "HEAD")
+}
+
+// Invalidate drops the cached sitemap and robots.txt, they are rebuilt on the next request
+func (h *Handler) Invalidate() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pages = nil
+	h.robots = nil
+}
+
+func (h *Handler) handleSitemap(w http.ResponseWriter, r *http.Request) {
+	pages, err := h.sitemap()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error building sitemap: %w", err))
+		return
+	}
+
+	page := 0
+	if p, ok := mux.Vars(r)["page"]; ok {
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 1 || page >= len(pages) {
+			utils.WriteError(w, http.StatusNotFound, fmt.Errorf("sitemap not found"))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(pages[page])
+	}
+}
+
+func (h *Handler) handleRobots(w http.ResponseWriter, r *http.Request) {
+	robots, err := h.robotsTxt()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error reading robots.txt: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(robots)
+	}
+}
+
+// sitemap returns the cached sitemap pages, building them when the cache is empty or expired
+func (h *Handler) sitemap() ([][]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pages != nil && time.Since(h.builtAt) < cacheTTL {
+		return h.pages, nil
+	}
+
+	entries, err := h.store.GetSitemapEntries()
+	if err != nil {
+		return nil, err
+	}
+	pages, err := buildSitemap(*entries, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	h.pages = pages
+	h.builtAt = time.Now()
+	return pages, nil
+}
+
+/*
+robotsTxt returns robots.txt. ROBOTS_FILE replaces it with the content of a file,
+otherwise it allows everything but ROBOTS_DISALLOW and points to the sitemap
+*/
+func (h *Handler) robotsTxt() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.robots != nil {
+		return h.robots, nil
+	}
+
+	if config.Envs.RobotsFile != "" {
+		robots, err := os.ReadFile(config.Envs.RobotsFile)
+		if err != nil {
+			return nil, err
+		}
+		h.robots = robots
+		return robots, nil
+	}
+
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	if len(config.Envs.RobotsDisallow) == 0 {
+		b.WriteString("Disallow:\n")
+	}
+	for _, path := range config.Envs.RobotsDisallow {
+		fmt.Fprintf(&b, "Disallow: %s\n", path)
+	}
+	fmt.Fprintf(&b, "\nSitemap: %s/sitemap.xml\n", config.Envs.PublicHost)
+	h.robots = []byte(b.String())
+	return h.robots, nil
+}
+
+// === === XML === ===
+
+type urlSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+/*
+buildSitemap renders the entries as a single urlset, or when there are more than maxURLs
+as a sitemap index (pages[0]) pointing to /sitemap-1.xml, /sitemap-2.xml, ...
+*/
+func buildSitemap(entries []types.SitemapEntry, now time.Time) ([][]byte, error) {
+	var sets []urlSet
+	for i := 0; i < len(entries) || i == 0; i += maxURLs {
+		end := min(i+maxURLs, len(entries))
+		set := urlSet{URLs: make([]sitemapURL, 0, end-i)}
+		for _, e := range entries[i:end] {
+			u := sitemapURL{Loc: config.Envs.PublicHost + e.Path}
+			if !e.LastMod.IsZero() {
+				u.LastMod = e.LastMod.UTC().Format(time.RFC3339)
+			}
+			set.URLs = append(set.URLs, u)
+		}
+		sets = append(sets, set)
+	}
+
+	if len(sets) == 1 {
+		page, err := marshalXML(sets[0])
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{page}, nil
+	}
+
+	index := sitemapIndex{}
+	pages := [][]byte{nil}
+	for i, set := range sets {
+		page, err := marshalXML(set)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{
+			Loc:     fmt.Sprintf("%s/sitemap-%d.xml", config.Envs.PublicHost, i+1),
+			LastMod: lastMod(set, now),
+		})
+	}
+	page, err := marshalXML(index)
+	if err != nil {
+		return nil, err
+	}
+	pages[0] = page
+	return pages, nil
+}
+
+// lastMod is the newest lastmod of a urlset, as rfc 3339 timestamps sort lexically
+func lastMod(set urlSet, now time.Time) string {
+	latest := ""
+	for _, u := range set.URLs {
+		if u.LastMod > latest {
+			latest = u.LastMod
+		}
+	}
+	if latest == "" {
+		return now.UTC().Format(time.RFC3339)
+	}
+	return latest
+}
+
+func marshalXML(v any) ([]byte, error) {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
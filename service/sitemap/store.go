@@ -0,0 +1,79 @@
+package sitemap
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/izumii.cxde/blog-api/types"
+	"gorm.io/gorm"
+)
+
+type Store struct {
+	db *gorm.DB
+}
+
+func NewStore(db *gorm.DB) *Store {
+	return &Store{db: db}
+}
+
+type row struct {
+	Key     string
+	LastMod time.Time
+}
+
+/*
+GetSitemapEntries returns the urls of every published blog, and of the authors, tags and
+categories that have published blogs. lastmod is the UpdatedAt of the newest blog on the page
+*/
+func (s *Store) GetSitemapEntries() (*[]types.SitemapEntry, error) {
+	published := s.db.Table("blogs").Where("blogs.deleted_at IS NULL AND blogs.status = ?", types.BlogStatusPublished)
+	queries := []struct {
+		query *gorm.DB
+		path  func(key string) string
+	}{
+		{
+			query: published.Session(&gorm.Session{}).
+				Select("blogs.slug AS key, blogs.updated_at AS last_mod").
+				Order("blogs.id"),
+			path: func(slug string) string { return "/api/v1/posts/" + slug },
+		},
+		{
+			query: published.Session(&gorm.Session{}).
+				Select("CAST(blogs.user_id AS TEXT) AS key, MAX(blogs.updated_at) AS last_mod").
+				Joins("JOIN users ON users.id = blogs.user_id AND users.deleted_at IS NULL").
+				Group("blogs.user_id").
+				Order("blogs.user_id"),
+			path: func(id string) string { return "/api/v1/blogs?author=" + id },
+		},
+		{
+			query: published.Session(&gorm.Session{}).
+				Select("tags.name AS key, MAX(blogs.updated_at) AS last_mod").
+				Joins("JOIN blog_tags ON blog_tags.blog_id = blogs.id").
+				Joins("JOIN tags ON tags.id = blog_tags.tag_id AND tags.deleted_at IS NULL").
+				Group("tags.name").
+				Order("tags.name"),
+			path: func(name string) string { return "/api/v1/tags/" + url.PathEscape(name) + "/blogs" },
+		},
+		{
+			query: published.Session(&gorm.Session{}).
+				Select("categories.slug AS key, MAX(blogs.updated_at) AS last_mod").
+				Joins("JOIN categories ON categories.id = blogs.category_id").
+				Group("categories.slug").
+				Order("categories.slug"),
+			path: func(slug string) string { return "/api/v1/categories/" + slug + "/blogs" },
+		},
+	}
+
+	entries := []types.SitemapEntry{}
+	for _, q := range queries {
+		var rows []row
+		if err := q.query.Scan(&rows).Error; err != nil {
+			return nil, fmt.Errorf("error loading sitemap entries: %w", err)
+		}
+		for _, r := range rows {
+			entries = append(entries, types.SitemapEntry{Path: q.path(r.Key), LastMod: r.LastMod})
+		}
+	}
+	return &entries, nil
+}
@@ -0,0 +1,96 @@
+package tag
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/service/auth"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+)
+
+type Handler struct {
+	store types.TagStore
+}
+
+func NewHandler(store types.TagStore) *Handler {
+	return &Handler{store: store}
+}
+
+/*
+RegisterRoutes registers the tag routes.
+@params: authMiddleware - authenticates the management routes
+*/
+func (h *Handler) RegisterRoutes(router *mux.Router, authMiddleware mux.MiddlewareFunc) {
+	public := router.PathPrefix("/").Subrouter()
+	public.HandleFunc("/tags", h.handleGetAllTags).Methods("GET")
+
+	// managing tags needs the taxonomy permission (editors and admins)
+	r := router.PathPrefix("/").Subrouter()
+	r.Handle("/tags/{name}", auth.Allow(types.PermissionManageTaxonomy, h.handleTagRename)).Methods("PATCH")
+	r.Handle("/tags/{name}/merge", auth.Allow(types.PermissionManageTaxonomy, h.handleTagMerge)).Methods("POST")
+	r.Handle("/tags/{name}", auth.Allow(types.PermissionManageTaxonomy, h.handleTagDeletion)).Methods("DELETE")
+
+	r.Use(authMiddleware)
+}
+
+func (h *Handler) handleGetAllTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := h.store.GetAllTags()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting tags: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, tags)
+}
+
+func (h *Handler) handleTagRename(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var p struct {
+		Name string `json:"name" validate:"required,min=1,max=50"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if err := h.store.RenameTag(name, p.Name); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to rename tag: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "tag renamed successfully"})
+}
+
+func (h *Handler) handleTagMerge(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var p struct {
+		Into string `json:"into" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+
+	if err := h.store.MergeTags(name, p.Into); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to merge tags: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "tags merged successfully"})
+}
+
+func (h *Handler) handleTagDeletion(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := h.store.DeleteTag(name); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to delete tag: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "tag deleted successfully"})
+}
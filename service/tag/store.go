@@ -0,0 +1,179 @@
+package tag
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/izumii.cxde/blog-api/service/blog"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+	"gorm.io/gorm"
+)
+
+type Store struct {
+	db *gorm.DB
+}
+
+func NewStore(db *gorm.DB) *Store {
+	return &Store{db: db}
+}
+
+/*
+GetAllTags returns every tag with the number of published blogs using it, most used first
+*/
+func (s *Store) GetAllTags() (*[]types.TagUsage, error) {
+	var tags []types.TagUsage
+	err := s.db.Model(&types.Tag{}).
+		Select("tags.name, COUNT(blogs.id) AS count").
+		Joins("LEFT JOIN blog_tags ON blog_tags.tag_id = tags.id").
+		Joins("LEFT JOIN blogs ON blogs.id = blog_tags.blog_id AND blogs.deleted_at IS NULL AND blogs.status = ?", types.BlogStatusPublished).
+		Group("tags.name").
+		Order("count DESC, tags.name ASC").
+		Scan(&tags).Error
+	if err != nil {
+		return nil, err
+	}
+	return &tags, nil
+}
+
+/*
+RenameTag renames a tag. If a tag with the new name already exists the two are merged
+@params: name - the current tag name, newName - the name to rename it to
+*/
+func (s *Store) RenameTag(name, newName string) error {
+	newName = utils.NormalizeTag(newName)
+	if newName == "" {
+		return fmt.Errorf("tag name cannot be empty")
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		tag, err := getTag(tx, name)
+		if err != nil {
+			return err
+		}
+		if tag.Name == newName {
+			return nil
+		}
+
+		var existing types.Tag
+		err = tx.Where("name = ?", newName).First(&existing).Error
+		if err == nil {
+			return mergeTags(tx, *tag, existing)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if err := tx.Model(tag).Update("name", newName).Error; err != nil {
+			return err
+		}
+		return refreshTaggedBlogs(tx, tag.ID)
+	})
+}
+
+/*
+MergeTags moves every blog tagged with name over to the tag into, then deletes name
+@params: name - the tag to merge away, into - the tag to keep
+*/
+func (s *Store) MergeTags(name, into string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		from, err := getTag(tx, name)
+		if err != nil {
+			return err
+		}
+		to, err := getTag(tx, into)
+		if err != nil {
+			return err
+		}
+		if from.ID == to.ID {
+			return fmt.Errorf("cannot merge a tag into itself")
+		}
+		return mergeTags(tx, *from, *to)
+	})
+}
+
+/*
+DeleteTag removes a tag from every blog and deletes it
+@params: name - the tag to delete
+*/
+func (s *Store) DeleteTag(name string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		tag, err := getTag(tx, name)
+		if err != nil {
+			return err
+		}
+		// the blogs are looked up before their join rows are removed
+		var ids []uint
+		if err := tx.Model(&types.BlogTag{}).Where("tag_id = ?", tag.ID).Pluck("blog_id", &ids).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("tag_id = ?", tag.ID).Delete(&types.BlogTag{}).Error; err != nil {
+			return err
+		}
+		// hard delete, so the unique name is free to be used again
+		if err := tx.Unscoped().Delete(tag).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		return blog.RefreshSearchVector(tx.Where("id IN ?", ids))
+	})
+}
+
+/*
+NormalizeExistingTags merges tags created before names were normalised,
+so "Go" and "go " end up as a single "go" tag
+*/
+func (s *Store) NormalizeExistingTags() error {
+	var tags []types.Tag
+	if err := s.db.Order("id ASC").Find(&tags).Error; err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if utils.NormalizeTag(t.Name) == t.Name {
+			continue
+		}
+		if err := s.RenameTag(t.Name, t.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTag finds a tag by its exact name, falling back to the normalised name
+func getTag(tx *gorm.DB, name string) (*types.Tag, error) {
+	var tag types.Tag
+	err := tx.Where("name = ?", name).First(&tag).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = tx.Where("name = ?", utils.NormalizeTag(name)).First(&tag).Error
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tag not found: %w", err)
+	}
+	return &tag, nil
+}
+
+// mergeTags rewrites the blog_tags rows of from to point at to, then deletes from
+func mergeTags(tx *gorm.DB, from, to types.Tag) error {
+	// blogs that already have both tags only keep the row for to
+	err := tx.Exec(`INSERT INTO blog_tags (blog_id, tag_id)
+		SELECT blog_id, ? FROM blog_tags WHERE tag_id = ?
+		ON CONFLICT DO NOTHING`, to.ID, from.ID).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("tag_id = ?", from.ID).Delete(&types.BlogTag{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Delete(&from).Error; err != nil {
+		return err
+	}
+	return refreshTaggedBlogs(tx, to.ID)
+}
+
+// refreshTaggedBlogs rebuilds the search document of every blog with the tag
+func refreshTaggedBlogs(tx *gorm.DB, tagId uint) error {
+	return blog.RefreshSearchVector(tx.Where("id IN (?)", tx.Model(&types.BlogTag{}).Select("blog_id").Where("tag_id = ?", tagId)))
+}
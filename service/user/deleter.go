@@ -0,0 +1,56 @@
+package user
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/izumii.cxde/blog-api/types"
+)
+
+// Deleter periodically deletes the accounts whose deletion grace period is over.
+type Deleter struct {
+	store    types.UserStore
+	interval time.Duration
+	onDelete []func()
+}
+
+func NewDeleter(store types.UserStore, interval time.Duration) *Deleter {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	return &Deleter{store: store, interval: interval}
+}
+
+// OnDelete registers fn to be called after a run that deleted at least one account
+func (d *Deleter) OnDelete(fn func()) {
+	d.onDelete = append(d.onDelete, fn)
+}
+
+// Start runs the deleter until the context is cancelled. It is meant to be run in its own goroutine
+func (d *Deleter) Start(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.delete()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Deleter) delete() {
+	n, err := d.store.DeleteScheduledUsers(time.Now())
+	if err != nil {
+		slog.Error("failed to delete scheduled accounts: ", slog.String("error", err.Error()))
+	}
+	if n > 0 {
+		slog.Info("deleted scheduled accounts", slog.Int64("count", n))
+		for _, fn := range d.onDelete {
+			fn()
+		}
+	}
+}
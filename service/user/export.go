@@ -0,0 +1,93 @@
+package user
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/izumii.cxde/blog-api/types"
+)
+
+/*
+writeExport writes the data export of a user as a zip archive: one json file per kind of data,
+and every blog as a markdown file with its metadata in a front matter
+*/
+func writeExport(w io.Writer, e *types.UserExport) error {
+	z := zip.NewWriter(w)
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", e.User},
+		{"sessions.json", e.Sessions},
+		{"blogs.json", e.Blogs},
+		{"tags.json", e.Tags},
+		{"comments.json", e.Comments},
+		{"reactions.json", e.Reactions},
+		{"bookmarks.json", e.Bookmarks},
+		{"reading_lists.json", e.ReadingLists},
+		{"identities.json", e.Identities},
+	}
+	for _, f := range files {
+		fw, err := z.Create(f.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.name, err)
+		}
+	}
+
+	for _, b := range e.Blogs {
+		fw, err := z.Create(fmt.Sprintf("blogs/%d-%s.md", b.ID, b.Slug))
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, blogMarkdown(b)); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// blogMarkdown renders a blog as markdown, with a yaml front matter holding everything but the content
+func blogMarkdown(b types.Blog) string {
+	var sb strings.Builder
+	field := func(name, value string) {
+		fmt.Fprintf(&sb, "%s: %s\n", name, strconv.Quote(value))
+	}
+	date := func(name string, t *time.Time) {
+		if t != nil {
+			field(name, t.Format(time.RFC3339))
+		}
+	}
+
+	sb.WriteString("---\n")
+	field("title", b.Title)
+	field("description", b.Description)
+	field("slug", b.Slug)
+	field("status", string(b.Status))
+	if b.Category != nil {
+		field("category", b.Category.Name)
+	}
+	sb.WriteString("tags:\n")
+	for _, t := range b.Tags {
+		fmt.Fprintf(&sb, "  - %s\n", strconv.Quote(t.Name))
+	}
+	date("created_at", &b.CreatedAt)
+	date("updated_at", &b.UpdatedAt)
+	date("published_at", b.PublishedAt)
+	if b.DeletedAt.Valid {
+		date("deleted_at", &b.DeletedAt.Time)
+	}
+	sb.WriteString("---\n\n")
+	sb.WriteString(b.Content)
+	sb.WriteString("\n")
+	return sb.String()
+}
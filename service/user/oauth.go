@@ -0,0 +1,304 @@
+package user
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/service/auth"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// how long a social login can take between the redirect to the provider and the callback
+const oauthStateTTL = 10 * time.Minute
+
+// how long logging in again through a provider confirms sensitive changes of an account without a password
+const reauthTTL = 5 * time.Minute
+
+// the state cookie ties the callback to the browser that started the login
+const (
+	oauthStateCookie = "oauth_state"
+	oauthCookiePath  = "/api/v1/oauth"
+)
+
+// provider returns the provider named in the route, writing a 404 when it is not configured
+func (h *Handler) provider(w http.ResponseWriter, r *http.Request) *oauthProvider {
+	p, ok := h.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown login provider"))
+		return nil
+	}
+	return p
+}
+
+// handleGetProviders lists the configured social login providers
+func (h *Handler) handleGetProviders(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(h.providers))
+	for name := range h.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	utils.WriteJSON(w, http.StatusOK, names)
+}
+
+// handleOAuthLogin redirects to the provider to log in, or register, with it
+func (h *Handler) handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	h.startOAuth(w, r, types.OAuthState{})
+}
+
+// handleOAuthLink redirects the logged in user to the provider to link another identity to their account
+func (h *Handler) handleOAuthLink(w http.ResponseWriter, r *http.Request) {
+	userId := uint(r.Context().Value(types.UserIDKey).(int64))
+	h.startOAuth(w, r, types.OAuthState{LinkUserID: &userId})
+}
+
+/*
+handleOAuthReauth redirects the logged in user to the provider to log in again. accounts without a
+password confirm changing their email, deleting the account and the like this way, see confirmUser
+*/
+func (h *Handler) handleOAuthReauth(w http.ResponseWriter, r *http.Request) {
+	sessionId, _ := r.Context().Value(types.SessionIDKey).(uint)
+	h.startOAuth(w, r, types.OAuthState{ReauthSessionID: &sessionId})
+}
+
+/*
+startOAuth starts the authorization code flow. the state, the OpenID Connect nonce and the
+PKCE verifier are kept on the server, and the state is also set as a cookie for the callback
+@params: st - what the flow is for, LinkUserID or ReauthSessionID. neither is set for logins
+*/
+func (h *Handler) startOAuth(w http.ResponseWriter, r *http.Request, st types.OAuthState) {
+	p := h.provider(w, r)
+	if p == nil {
+		return
+	}
+	c, err := p.config()
+	if err != nil {
+		utils.WriteError(w, http.StatusBadGateway, err)
+		return
+	}
+	state, err := auth.GenerateToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate state: %w", err))
+		return
+	}
+	nonce, err := auth.GenerateToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate nonce: %w", err))
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	st.StateHash = auth.HashToken(state)
+	st.Provider = p.cfg.Name
+	st.Nonce = nonce
+	st.CodeVerifier = verifier
+	st.ExpiresAt = time.Now().Add(oauthStateTTL)
+	err = h.store.CreateOAuthState(&st)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to save state: %w", err))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     oauthCookiePath,
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		// lax, as the callback is a redirect from the provider's site
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	opts := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(verifier)}
+	if !p.isGitHub() {
+		opts = append(opts, oidc.Nonce(nonce))
+	}
+	http.Redirect(w, r, c.AuthCodeURL(state, opts...), http.StatusFound)
+}
+
+/*
+handleOAuthCallback finishes a social login. the user is found by the identity, or else by its
+email, which the provider must have verified. unknown emails register a new user
+*/
+func (h *Handler) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	p := h.provider(w, r)
+	if p == nil {
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("login with %s failed: %s", p.cfg.Name, e))
+		return
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid state"))
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: oauthCookiePath, MaxAge: -1, HttpOnly: true, Secure: true})
+
+	st, err := h.store.ConsumeOAuthState(auth.HashToken(state), p.cfg.Name)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	a, err := p.account(r.Context(), query.Get("code"), st.CodeVerifier, st.Nonce)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("login with %s failed: %w", p.cfg.Name, err))
+		return
+	}
+	identity := types.ExternalIdentity{Provider: p.cfg.Name, Subject: a.Subject, Email: a.Email}
+
+	if st.LinkUserID != nil {
+		identity.UserID = *st.LinkUserID
+		if err := h.store.LinkIdentity(identity, false); err != nil {
+			utils.WriteError(w, http.StatusConflict, fmt.Errorf("failed to link account: %w", err))
+			return
+		}
+		utils.WriteJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("%s account linked", p.cfg.Name)})
+		return
+	}
+	if st.ReauthSessionID != nil {
+		h.reauthenticate(w, identity, *st.ReauthSessionID)
+		return
+	}
+
+	u, err := h.oauthUser(identity, a)
+	if err != nil {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("login with %s failed: %w", p.cfg.Name, err))
+		return
+	}
+	if u.SuspendedAt != nil {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("account suspended"))
+		return
+	}
+	required, err := h.twoFactorRequired(u)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("auth failed: %w", err))
+		return
+	}
+	if required {
+		h.startLoginChallenge(w, u)
+		return
+	}
+	if err := StartSession(w, r, h.store, *u, nil); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("auth failed: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "login successful"})
+}
+
+// reauthenticate marks the session as confirmed when the identity belongs to its user
+func (h *Handler) reauthenticate(w http.ResponseWriter, identity types.ExternalIdentity, sessionId uint) {
+	u, err := h.store.GetUserByIdentity(identity.Provider, identity.Subject)
+	if err != nil {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("the %s account is not linked to the logged in user", identity.Provider))
+		return
+	}
+	if err := h.store.ReauthenticateSession(int64(u.ID), sessionId); err != nil {
+		utils.WriteError(w, http.StatusForbidden, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{
+		"message": fmt.Sprintf("confirmed, the changes that need it can be made for the next %.0f minutes", reauthTTL.Minutes()),
+	})
+}
+
+/*
+confirmUser checks that the logged in user is really the owner of the account before a sensitive change.
+it takes the password, or for accounts without one (registered through a provider, or whose unverified
+password was dropped when linking one), a login through one of their providers in the last few minutes
+*/
+func (h *Handler) confirmUser(r *http.Request, u *types.User, password string) error {
+	if u.Password != "" {
+		if !auth.CompareHashPassword(u.Password, password) {
+			return fmt.Errorf("invalid credentials")
+		}
+		return nil
+	}
+	sessionId, _ := r.Context().Value(types.SessionIDKey).(uint)
+	session, err := h.store.GetSession(int64(u.ID), sessionId)
+	if err != nil || session.ReauthenticatedAt == nil || time.Since(*session.ReauthenticatedAt) > reauthTTL {
+		return fmt.Errorf("the account has no password, log in again through GET /oauth/{provider}/reauth first")
+	}
+	return nil
+}
+
+// oauthUser returns the user of a social login, linking or registering them on their first one
+func (h *Handler) oauthUser(identity types.ExternalIdentity, a *externalAccount) (*types.User, error) {
+	// only a missing identity or email falls through to linking and registering, any other
+	// error could otherwise register a second account for the same person
+	u, err := h.store.GetUserByIdentity(identity.Provider, identity.Subject)
+	if err == nil {
+		return u, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	// without a verified email anyone could claim an account by setting its email at the provider
+	if a.Email == "" || !a.EmailVerified {
+		return nil, fmt.Errorf("the %s account has no verified email", identity.Provider)
+	}
+
+	u, err = h.store.GetUserByEmail(a.Email)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		identity.UserID = u.ID
+		if err := h.store.LinkIdentity(identity, true); err != nil {
+			return nil, err
+		}
+		// linking may have verified the account, which logs it out everywhere
+		return h.store.GetUserById(int64(u.ID))
+	}
+
+	firstName := a.FirstName
+	if firstName == "" {
+		firstName, _, _ = strings.Cut(a.Email, "@")
+	}
+	return h.store.CreateOAuthUser(types.User{
+		FirstName: firstName,
+		LastName:  a.LastName,
+		Email:     a.Email,
+		AvatarUrl: a.AvatarUrl,
+		Verified:  true,
+	}, identity)
+}
+
+// handleGetIdentities lists the social logins linked to the user
+func (h *Handler) handleGetIdentities(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	identities, err := h.store.GetIdentities(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting identities: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, identities)
+}
+
+// handleDeleteIdentity unlinks a social login from the user
+func (h *Handler) handleDeleteIdentity(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid identity id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	if err := h.store.DeleteIdentity(userId, uint(id)); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to unlink account: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "account unlinked"})
+}
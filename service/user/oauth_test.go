@@ -0,0 +1,263 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/config"
+	"github.com/izumii.cxde/blog-api/types"
+	"gorm.io/gorm"
+)
+
+// oauthStore keeps the state of a social login in memory. everything else of the store is unused
+type oauthStore struct {
+	types.UserStore
+	states     map[string]*types.OAuthState
+	users      map[string]*types.User // by email
+	identities []types.ExternalIdentity
+	created    []types.User
+}
+
+func newOAuthStore() *oauthStore {
+	return &oauthStore{states: map[string]*types.OAuthState{}, users: map[string]*types.User{}}
+}
+
+func (s *oauthStore) CreateOAuthState(st *types.OAuthState) error {
+	s.states[st.StateHash] = st
+	return nil
+}
+
+func (s *oauthStore) ConsumeOAuthState(stateHash, provider string) (*types.OAuthState, error) {
+	st, ok := s.states[stateHash]
+	if !ok || st.Provider != provider {
+		return nil, fmt.Errorf("invalid or expired state")
+	}
+	delete(s.states, stateHash)
+	return st, nil
+}
+
+func (s *oauthStore) GetUserByIdentity(provider, subject string) (*types.User, error) {
+	for _, i := range s.identities {
+		if i.Provider == provider && i.Subject == subject {
+			return s.GetUserById(int64(i.UserID))
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *oauthStore) GetUserByEmail(email string) (*types.User, error) {
+	if u, ok := s.users[email]; ok {
+		return u, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *oauthStore) GetUserById(id int64) (*types.User, error) {
+	for _, u := range s.users {
+		if int64(u.ID) == id {
+			return u, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (s *oauthStore) LinkIdentity(identity types.ExternalIdentity, verifyAccount bool) error {
+	s.identities = append(s.identities, identity)
+	return nil
+}
+
+func (s *oauthStore) CreateOAuthUser(u types.User, identity types.ExternalIdentity) (*types.User, error) {
+	u.ID = uint(100 + len(s.created))
+	s.created = append(s.created, u)
+	s.users[u.Email] = &u
+	identity.UserID = u.ID
+	s.identities = append(s.identities, identity)
+	return &u, nil
+}
+
+func (s *oauthStore) RoleRequiresTwoFactor(role types.Role) (bool, error) { return false, nil }
+func (s *oauthStore) CreateSession(session *types.Session) error          { return nil }
+func (s *oauthStore) CreateRefreshToken(userId int64, familyId, tokenHash string, expiresAt time.Time) error {
+	return nil
+}
+
+/*
+issuer is an OpenID Connect provider serving discovery, its signing keys and a token endpoint.
+the token endpoint only hands out an id token for the code it issued and the PKCE verifier of the
+login, and signs whatever claims the test sets
+*/
+type issuer struct {
+	*httptest.Server
+	key           *rsa.PrivateKey
+	challenge     string // the PKCE challenge and nonce of the last authorization request
+	nonce         string
+	email         string
+	emailVerified bool
+	wrongNonce    bool
+}
+
+func newIssuer(t *testing.T) *issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &issuer{key: key, email: "alice@example.com", emailVerified: true}
+
+	m := http.NewServeMux()
+	m.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                iss.URL,
+			"authorization_endpoint":                iss.URL + "/authorize",
+			"token_endpoint":                        iss.URL + "/token",
+			"jwks_uri":                              iss.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	m.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "test", "alg": "RS256", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	m.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != "code" || base64.RawURLEncoding.EncodeToString(sum[:]) != iss.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		nonce := iss.nonce
+		if iss.wrongNonce {
+			nonce = "another login's nonce"
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            iss.URL,
+			"aud":            "client",
+			"sub":            "subject",
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"nonce":          nonce,
+			"email":          iss.email,
+			"email_verified": iss.emailVerified,
+			"given_name":     "Alice",
+		})
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access", "token_type": "Bearer", "expires_in": 3600, "id_token": idToken,
+		})
+	})
+	iss.Server = httptest.NewServer(m)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// login runs a social login through the router: the redirect to the issuer, then its callback
+func (iss *issuer) login(t *testing.T, router *mux.Router, withCookie bool) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/oauth/mock/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: got status %d, want %d", rec.Code, http.StatusFound)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("nonce") == "" {
+		t.Fatalf("login: authorization request without PKCE or nonce: %s", location)
+	}
+	iss.challenge, iss.nonce = query.Get("code_challenge"), query.Get("nonce")
+
+	req := httptest.NewRequest("GET", "/api/v1/oauth/mock/callback?code=code&state="+url.QueryEscape(query.Get("state")), nil)
+	if withCookie {
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+	}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOAuthCallback(t *testing.T) {
+	config.Envs.JWTSecret = "secret"
+
+	tests := []struct {
+		name          string
+		existing      *types.User // a user registered with the email before
+		emailVerified bool
+		wrongNonce    bool
+		withoutCookie bool
+		wantStatus    int
+		wantError     string // part of the error message
+		wantLinked    bool
+		wantCreated   bool
+	}{
+		{name: "new user registers", emailVerified: true, wantStatus: http.StatusOK, wantCreated: true},
+		{name: "verified email links the existing user", existing: &types.User{Email: "alice@example.com"},
+			emailVerified: true, wantStatus: http.StatusOK, wantLinked: true},
+		{name: "unverified email is not linked", existing: &types.User{Email: "alice@example.com"},
+			emailVerified: false, wantStatus: http.StatusForbidden, wantError: "no verified email"},
+		{name: "unverified email does not register", emailVerified: false, wantStatus: http.StatusForbidden,
+			wantError: "no verified email"},
+		{name: "nonce mismatch", emailVerified: true, wrongNonce: true, wantStatus: http.StatusUnauthorized,
+			wantError: "nonce mismatch"},
+		{name: "state without its cookie", emailVerified: true, withoutCookie: true, wantStatus: http.StatusBadRequest,
+			wantError: "invalid state"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iss := newIssuer(t)
+			iss.emailVerified, iss.wrongNonce = tt.emailVerified, tt.wrongNonce
+
+			store := newOAuthStore()
+			if tt.existing != nil {
+				tt.existing.ID = 7
+				store.users[tt.existing.Email] = tt.existing
+			}
+			h := &Handler{store: store, providers: newOAuthProviders(map[string]config.OAuthProvider{
+				"mock": {Name: "mock", ClientID: "client", ClientSecret: "secret", Issuer: iss.URL},
+			})}
+			router := mux.NewRouter()
+			h.RegisterRoutes(router.PathPrefix("/api/v1").Subrouter(), func(next http.Handler) http.Handler { return next })
+
+			rec := iss.login(t, router, !tt.withoutCookie)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("callback: got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantError) {
+				t.Errorf("callback: got %s, want an error containing %q", rec.Body.String(), tt.wantError)
+			}
+			if linked := tt.existing != nil && len(store.identities) > 0 && store.identities[0].UserID == tt.existing.ID; linked != tt.wantLinked {
+				t.Errorf("linked to the existing user: got %v, want %v", linked, tt.wantLinked)
+			}
+			if created := len(store.created) > 0; created != tt.wantCreated {
+				t.Errorf("registered a user: got %v, want %v", created, tt.wantCreated)
+			}
+			if tt.wantStatus != http.StatusOK && len(store.identities) > 0 {
+				t.Errorf("a failed login linked an identity: %+v", store.identities)
+			}
+		})
+	}
+}
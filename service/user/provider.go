@@ -0,0 +1,208 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/izumii.cxde/blog-api/config"
+	"golang.org/x/oauth2"
+)
+
+// externalAccount is what a provider tells about the account that signed in
+type externalAccount struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	FirstName     string
+	LastName      string
+	AvatarUrl     string
+}
+
+/*
+oauthProvider is a configured social login provider. OpenID Connect providers are discovered from
+their issuer on first use rather than on startup, so a provider being down doesn't stop the server
+*/
+type oauthProvider struct {
+	cfg config.OAuthProvider
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier // nil for github
+}
+
+func newOAuthProviders(cfgs map[string]config.OAuthProvider) map[string]*oauthProvider {
+	providers := make(map[string]*oauthProvider, len(cfgs))
+	for name, cfg := range cfgs {
+		if name == "google" && cfg.Issuer == "" {
+			cfg.Issuer = "https://accounts.google.com"
+		}
+		providers[name] = &oauthProvider{cfg: cfg}
+	}
+	return providers
+}
+
+func (p *oauthProvider) isGitHub() bool {
+	return p.cfg.Name == "github" && p.cfg.Issuer == ""
+}
+
+// config returns the oauth2 config of the provider, discovering the OpenID Connect endpoints the first time
+func (p *oauthProvider) config() (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth != nil {
+		return p.oauth, nil
+	}
+
+	c := &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		RedirectURL:  fmt.Sprintf("%s/api/v1/oauth/%s/callback", config.Envs.PublicHost, p.cfg.Name),
+		Scopes:       p.cfg.Scopes,
+	}
+	if p.isGitHub() {
+		c.Endpoint = oauth2.Endpoint{
+			AuthURL:  valueOr(p.cfg.AuthURL, "https://github.com/login/oauth/authorize"),
+			TokenURL: valueOr(p.cfg.TokenURL, "https://github.com/login/oauth/access_token"),
+		}
+		if len(c.Scopes) == 0 {
+			c.Scopes = []string{"read:user", "user:email"}
+		}
+	} else {
+		// the provider keeps using the context to refresh its signing keys, so it must not be cancelled
+		provider, err := oidc.NewProvider(context.Background(), p.cfg.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover %s: %w", p.cfg.Name, err)
+		}
+		c.Endpoint = provider.Endpoint()
+		if len(c.Scopes) == 0 {
+			c.Scopes = []string{"profile", "email"}
+		}
+		c.Scopes = append([]string{oidc.ScopeOpenID}, c.Scopes...)
+		p.verifier = provider.Verifier(&oidc.Config{ClientID: p.cfg.ClientID})
+	}
+	p.oauth = c
+	return c, nil
+}
+
+/*
+account exchanges the authorization code and returns the account that signed in
+@params:
+verifier - the PKCE code verifier sent along with the code
+nonce - the nonce the ID token must carry (OpenID Connect only)
+*/
+func (p *oauthProvider) account(ctx context.Context, code, verifier, nonce string) (*externalAccount, error) {
+	c, err := p.config()
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	if p.isGitHub() {
+		return p.githubAccount(ctx, c.Client(ctx, token))
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id token in the token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("invalid id token: nonce mismatch")
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified any    `json:"email_verified"` // some providers send it as a string
+		Name          string `json:"name"`
+		GivenName     string `json:"given_name"`
+		FamilyName    string `json:"family_name"`
+		Picture       string `json:"picture"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("invalid id token claims: %w", err)
+	}
+
+	a := &externalAccount{
+		Subject:   idToken.Subject,
+		Email:     claims.Email,
+		FirstName: claims.GivenName,
+		LastName:  claims.FamilyName,
+		AvatarUrl: claims.Picture,
+	}
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		a.EmailVerified = v
+	case string:
+		a.EmailVerified, _ = strconv.ParseBool(v)
+	}
+	if a.FirstName == "" {
+		a.FirstName, a.LastName, _ = strings.Cut(claims.Name, " ")
+	}
+	return a, nil
+}
+
+// githubAccount reads the account from the GitHub api. the email is the verified primary one, if any
+func (p *oauthProvider) githubAccount(ctx context.Context, client *http.Client) (*externalAccount, error) {
+	api := strings.TrimSuffix(valueOr(p.cfg.APIURL, "https://api.github.com"), "/")
+
+	var u struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarUrl string `json:"avatar_url"`
+	}
+	if err := getJSON(ctx, client, api+"/user", &u); err != nil {
+		return nil, err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, api+"/user/emails", &emails); err != nil {
+		return nil, err
+	}
+
+	a := &externalAccount{Subject: strconv.FormatInt(u.ID, 10), AvatarUrl: u.AvatarUrl}
+	a.FirstName, a.LastName, _ = strings.Cut(valueOr(u.Name, u.Login), " ")
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			a.Email, a.EmailVerified = e.Email, true
+		}
+	}
+	return a, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func valueOr(v, fallback string) string {
+	if v == "" {
+		return fallback
+	}
+	return v
+}
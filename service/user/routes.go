@@ -1,30 +1,85 @@
 package user
 
 import (
+	"bytes"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/izumii.cxde/blog-api/config"
 	"github.com/izumii.cxde/blog-api/service/auth"
 	"github.com/izumii.cxde/blog-api/types"
 	"github.com/izumii.cxde/blog-api/utils"
 )
 
+// how long a password reset link stays valid
+const passwordResetTTL = 30 * time.Minute
+
+// how long the new address has to confirm an email change, and the old one to undo it
+const (
+	emailChangeTTL     = 24 * time.Hour
+	emailChangeUndoTTL = 7 * 24 * time.Hour
+)
+
 type Handler struct {
-	store types.UserStore
+	store     types.UserStore
+	providers map[string]*oauthProvider
 }
 
 func NewHandler(store types.UserStore) *Handler {
-	return &Handler{store: store}
+	return &Handler{store: store, providers: newOAuthProviders(config.Envs.OAuthProviders)}
 }
 
-func (h *Handler) RegisterRoutes(router *mux.Router) {
+/*
+RegisterRoutes registers the account routes.
+@params: authMiddleware - authenticates the routes that need a logged in user
+*/
+func (h *Handler) RegisterRoutes(router *mux.Router, authMiddleware mux.MiddlewareFunc) {
 	router.HandleFunc("/login", h.handleLogin).Methods("POST")
+	router.HandleFunc("/login/2fa", h.handleLoginTwoFactor).Methods("POST")
+	router.HandleFunc("/login/2fa/setup", h.handleLoginTwoFactorSetup).Methods("POST")
+	router.HandleFunc("/oauth/providers", h.handleGetProviders).Methods("GET")
+	router.HandleFunc("/oauth/{provider}/login", h.handleOAuthLogin).Methods("GET")
+	router.HandleFunc("/oauth/{provider}/callback", h.handleOAuthCallback).Methods("GET")
+	router.HandleFunc("/token/refresh", h.handleRefresh).Methods("POST")
+	router.HandleFunc("/logout", h.handleLogout).Methods("POST")
 	router.HandleFunc("/register", h.handleRegister).Methods("POST")
 
 	router.HandleFunc("/verify", h.handleVerification).Methods("POST")
 	router.HandleFunc("/get-verification-code", h.handleSendVerificationCode).Methods("GET")
+
+	router.HandleFunc("/password/forgot", h.handleForgotPassword).Methods("POST")
+	router.HandleFunc("/password/reset", h.handleResetPassword).Methods("POST")
+
+	router.HandleFunc("/me/email/confirm", h.handleConfirmEmailChange).Methods("POST")
+	router.HandleFunc("/me/email/undo", h.handleUndoEmailChange).Methods("POST")
+
+	router.HandleFunc("/users/{id:[0-9]+}", h.handleGetProfile).Methods("GET")
+
+	r := router.PathPrefix("/").Subrouter()
+	r.HandleFunc("/me", h.handleGetMe).Methods("GET")
+	r.HandleFunc("/me", h.handleUpdateMe).Methods("PATCH")
+	r.HandleFunc("/me", h.handleDeleteMe).Methods("DELETE")
+	r.HandleFunc("/me/deletion/cancel", h.handleCancelDeletion).Methods("POST")
+	r.HandleFunc("/me/export", h.handleExport).Methods("GET")
+	r.HandleFunc("/me/email", h.handleChangeEmail).Methods("POST")
+	r.HandleFunc("/oauth/{provider}/link", h.handleOAuthLink).Methods("GET")
+	r.HandleFunc("/oauth/{provider}/reauth", h.handleOAuthReauth).Methods("GET")
+	r.HandleFunc("/me/identities", h.handleGetIdentities).Methods("GET")
+	r.HandleFunc("/me/identities/{id:[0-9]+}", h.handleDeleteIdentity).Methods("DELETE")
+	r.HandleFunc("/me/2fa", h.handleDisableTwoFactor).Methods("DELETE")
+	r.HandleFunc("/me/2fa/setup", h.handleTwoFactorSetup).Methods("POST")
+	r.HandleFunc("/me/2fa/confirm", h.handleTwoFactorConfirm).Methods("POST")
+	r.HandleFunc("/me/2fa/recovery-codes", h.handleRegenerateRecoveryCodes).Methods("POST")
+	r.HandleFunc("/logout/all", h.handleLogoutEverywhere).Methods("POST")
+	r.HandleFunc("/me/sessions", h.handleGetSessions).Methods("GET")
+	r.HandleFunc("/me/sessions/{id:[0-9]+}", h.handleRevokeSession).Methods("DELETE")
+	r.Use(authMiddleware)
 }
 
 // HandleLogin handles the login request
@@ -51,23 +106,154 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid credentials"))
 		return
 	}
-	// generate the token
-	t, err := auth.GenerateJWTToken(*user)
+	if user.SuspendedAt != nil {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("account suspended"))
+		return
+	}
+	required, err := h.twoFactorRequired(user)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("auth failed: %w", err))
+		return
+	}
+	if required {
+		h.startLoginChallenge(w, user)
+		return
+	}
+	if err := StartSession(w, r, h.store, *user, nil); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("auth failed: %w", err))
+		return
 	}
 
-	// if all is good set the cookie
-	c := http.Cookie{
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "login successful"})
+}
+
+/*
+StartSession logs the user in: it records a session for the device the request came from,
+starts its refresh token family and sets the token cookies
+@params: impersonatorId - the admin acting as the user, nil for normal logins
+*/
+func StartSession(w http.ResponseWriter, r *http.Request, store types.UserStore, u types.User, impersonatorId *uint) error {
+	// every login starts a new refresh token family
+	familyId, err := auth.GenerateToken()
+	if err != nil {
+		return err
+	}
+	refreshToken, err := auth.GenerateToken()
+	if err != nil {
+		return err
+	}
+	// record the device the login came from
+	session := types.Session{
+		UserID:         u.ID,
+		FamilyID:       familyId,
+		UserAgent:      r.UserAgent(),
+		IP:             clientIP(r),
+		ImpersonatorID: impersonatorId,
+		LastSeenAt:     time.Now(),
+	}
+	if err := store.CreateSession(&session); err != nil {
+		return err
+	}
+	if err := store.CreateRefreshToken(int64(u.ID), familyId, auth.HashToken(refreshToken), time.Now().Add(auth.RefreshTokenTTL())); err != nil {
+		return err
+	}
+	return setAuthCookies(w, u, familyId, refreshToken)
+}
+
+// the refresh token cookie is only sent to the api, never to other paths of the host
+const refreshCookiePath = "/api/v1"
+
+// setAuthCookies sets the access token cookie and the refresh token cookie
+func setAuthCookies(w http.ResponseWriter, u types.User, familyId, refreshToken string) error {
+	t, err := auth.GenerateJWTToken(u, familyId)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
 		Name:     "token",
 		Value:    t,
-		Expires:  time.Now().Add(time.Hour * 24 * 7),
+		Path:     "/",
+		Expires:  time.Now().Add(auth.AccessTokenTTL()),
+		HttpOnly: true,
+		Secure:   true,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		Path:     refreshCookiePath,
+		Expires:  time.Now().Add(auth.RefreshTokenTTL()),
 		HttpOnly: true,
 		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// clearAuthCookies removes both token cookies from the browser
+func clearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: true})
+	http.SetCookie(w, &http.Cookie{Name: "refresh_token", Value: "", Path: refreshCookiePath, MaxAge: -1, HttpOnly: true, Secure: true})
+}
+
+// handleRefresh trades the refresh token cookie for a new access token and a new refresh token
+func (h *Handler) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie("refresh_token")
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
 	}
-	http.SetCookie(w, &c)
+	refreshToken, err := auth.GenerateToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("auth failed: %w", err))
+		return
+	}
+	t, err := h.store.RotateRefreshToken(auth.HashToken(c.Value), auth.HashToken(refreshToken), time.Now().Add(auth.RefreshTokenTTL()))
+	if err != nil {
+		clearAuthCookies(w)
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+	u, err := h.store.GetUserById(int64(t.UserID))
+	if err != nil || u.SuspendedAt != nil {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("user not found or suspended"))
+		return
+	}
+	if err := setAuthCookies(w, *u, t.FamilyID, refreshToken); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("auth failed: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "token refreshed"})
+}
 
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "login successful"})
+// handleLogout revokes the current login, found through the access token or the refresh token
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	familyId := ""
+	if claims, err := auth.ParseJWTRequestClaims(r); err == nil {
+		familyId = claims.FamilyId
+	} else if c, err := r.Cookie("refresh_token"); err == nil {
+		if t, err := h.store.GetRefreshToken(auth.HashToken(c.Value)); err == nil {
+			familyId = t.FamilyID
+		}
+	}
+	if familyId != "" {
+		if err := h.store.RevokeRefreshTokenFamily(familyId); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to log out: %w", err))
+			return
+		}
+	}
+	clearAuthCookies(w)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "logged out"})
+}
+
+// handleLogoutEverywhere revokes every login of the user, on every device
+func (h *Handler) handleLogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	if err := h.store.RevokeAllRefreshTokens(userId); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to log out: %w", err))
+		return
+	}
+	clearAuthCookies(w)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "logged out everywhere"})
 }
 
 func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -193,3 +379,340 @@ func (h *Handler) handleSendVerificationCode(w http.ResponseWriter, r *http.Requ
 	}
 	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "verification code sent successfully", "verification_code": otp})
 }
+
+/*
+handleForgotPassword emails a password reset link. it answers the same whether the email belongs
+to an account or not, and the email is sent in the background so the response time doesn't tell either
+*/
+func (h *Handler) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var p types.ForgotPasswordPayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+
+	go h.sendPasswordReset(p.Email)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "if an account exists for this email, a password reset link has been sent"})
+}
+
+// sendPasswordReset creates a reset token for the user with the email, if there is one, and mails the link
+func (h *Handler) sendPasswordReset(email string) {
+	u, err := h.store.GetUserByEmail(email)
+	if err != nil {
+		return
+	}
+	token, err := auth.GenerateToken()
+	if err != nil {
+		slog.Error("failed to generate password reset token: ", slog.String("error", err.Error()))
+		return
+	}
+	if err := h.store.CreatePasswordResetToken(int64(u.ID), auth.HashToken(token), time.Now().Add(passwordResetTTL)); err != nil {
+		slog.Error("failed to save password reset token: ", slog.String("error", err.Error()))
+		return
+	}
+
+	link := frontendLink("/reset-password", token)
+	if err := h.store.SendPasswordResetLink(u.Email, link, fmt.Sprintf("%s %s", u.FirstName, u.LastName), passwordResetTTL); err != nil {
+		slog.Error("failed to send password reset link: ", slog.String("error", err.Error()))
+	}
+}
+
+// frontendLink returns the link to a page of the frontend, which posts the token in it to the api
+func frontendLink(path, token string) string {
+	return fmt.Sprintf("%s%s?token=%s", config.Envs.FrontendURL, path, url.QueryEscape(token))
+}
+
+// handleResetPassword sets a new password with the token from a reset link and logs the user out everywhere
+func (h *Handler) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var p types.ResetPasswordPayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+
+	if err := h.store.ResetPassword(auth.HashToken(p.Token), p.Password); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to reset password: %w", err))
+		return
+	}
+	// the token cookies of this browser are now useless, drop them
+	clearAuthCookies(w)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "password reset successfully, please log in again"})
+}
+
+// clientIP returns the ip address of the client, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// handleGetSessions lists the devices the user is logged in on
+func (h *Handler) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	currentId, _ := r.Context().Value(types.SessionIDKey).(uint)
+
+	sessions, err := h.store.GetSessions(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("error getting sessions: %w", err))
+		return
+	}
+	for i := range *sessions {
+		(*sessions)[i].Current = (*sessions)[i].ID == currentId
+	}
+	utils.WriteJSON(w, http.StatusOK, sessions)
+}
+
+// handleRevokeSession logs out one of the user's devices
+func (h *Handler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid session id: %w", err))
+		return
+	}
+	userId := r.Context().Value(types.UserIDKey).(int64)
+
+	if err := h.store.RevokeSession(userId, uint(id)); err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("failed to revoke session: %w", err))
+		return
+	}
+	if currentId, _ := r.Context().Value(types.SessionIDKey).(uint); currentId == uint(id) {
+		clearAuthCookies(w)
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "session revoked"})
+}
+
+// handleGetMe returns the profile of the logged in user
+func (h *Handler) handleGetMe(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	u, err := h.store.GetUserById(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+// handleUpdateMe changes the name, avatar, bio, website or social links of the logged in user
+func (h *Handler) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var p types.UpdateProfilePayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+
+	u, err := h.store.UpdateProfile(userId, p)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update profile: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+// handleGetProfile returns the public profile of a user
+func (h *Handler) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user id: %w", err))
+		return
+	}
+	u, err := h.store.GetUserById(id)
+	if err != nil || u.SuspendedAt != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, u.PublicProfile())
+}
+
+/*
+handleChangeEmail starts an email change. the current password (or a fresh login through a provider) is required, the new address gets
+a link to confirm the change and the old one a notice with a link to undo it
+*/
+func (h *Handler) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var p types.ChangeEmailPayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+
+	u, err := h.store.GetUserById(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	if err := h.confirmUser(r, u, p.Password); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if p.NewEmail == u.Email {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("the new email is the same as the current one"))
+		return
+	}
+	// checked again when the change is confirmed, this only saves sending a link that can't work
+	if existing, err := h.store.GetUserByEmail(p.NewEmail); err == nil && existing != nil {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("email is already in use"))
+		return
+	}
+
+	confirmToken, err := auth.GenerateToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate token: %w", err))
+		return
+	}
+	undoToken, err := auth.GenerateToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate token: %w", err))
+		return
+	}
+	now := time.Now()
+	change := types.EmailChange{
+		UserID:           u.ID,
+		OldEmail:         u.Email,
+		NewEmail:         p.NewEmail,
+		ConfirmTokenHash: auth.HashToken(confirmToken),
+		UndoTokenHash:    auth.HashToken(undoToken),
+		ExpiresAt:        now.Add(emailChangeTTL),
+		UndoExpiresAt:    now.Add(emailChangeUndoTTL),
+	}
+	if err := h.store.CreateEmailChange(&change); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to save email change: %w", err))
+		return
+	}
+
+	username := fmt.Sprintf("%s %s", u.FirstName, u.LastName)
+	link := frontendLink("/confirm-email", confirmToken)
+	if err := h.store.SendEmailChangeConfirmation(p.NewEmail, link, username, emailChangeTTL); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to send confirmation: %w", err))
+		return
+	}
+	undoLink := frontendLink("/undo-email-change", undoToken)
+	if err := h.store.SendEmailChangeNotice(u.Email, undoLink, username, p.NewEmail); err != nil {
+		slog.Error("failed to send email change notice: ", slog.String("error", err.Error()))
+	}
+	utils.WriteJSON(w, http.StatusAccepted, map[string]string{"message": "a confirmation link has been sent to the new email"})
+}
+
+// handleConfirmEmailChange commits an email change with the token sent to the new address
+func (h *Handler) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var p types.TokenPayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+
+	if err := h.store.ConfirmEmailChange(auth.HashToken(p.Token)); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to change email: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "email changed successfully"})
+}
+
+// handleUndoEmailChange cancels or reverts an email change with the token sent to the old address
+func (h *Handler) handleUndoEmailChange(w http.ResponseWriter, r *http.Request) {
+	var p types.TokenPayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+
+	if err := h.store.UndoEmailChange(auth.HashToken(p.Token)); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to undo email change: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "email change undone"})
+}
+
+// handleExport sends the user a zip archive of everything stored about them
+func (h *Handler) handleExport(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	e, err := h.store.GetUserExport(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to export data: %w", err))
+		return
+	}
+	// built in memory first, so a failure can still be reported as an error response
+	var buf bytes.Buffer
+	if err := writeExport(&buf, e); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to export data: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%d-%s.zip"`, userId, time.Now().Format("2006-01-02")))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+/*
+handleDeleteMe schedules the deletion of the user's account after ACCOUNT_DELETION_GRACE_DAYS.
+the current password (or a fresh login through a provider) is required, and the user chooses whether their content is removed or anonymised
+*/
+func (h *Handler) handleDeleteMe(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var p types.DeleteAccountPayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+
+	u, err := h.store.GetUserById(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	if err := h.confirmUser(r, u, p.Password); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	at := time.Now().Add(24 * time.Hour * time.Duration(config.Envs.AccountDeletionGraceDays))
+	if err := h.store.ScheduleUserDeletion(userId, at, p.Content); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to schedule deletion: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusAccepted, map[string]string{
+		"message":               "your account will be deleted, log in and cancel before then to keep it",
+		"deletion_scheduled_at": at.Format(time.RFC3339),
+	})
+}
+
+// handleCancelDeletion keeps an account that is waiting to be deleted
+func (h *Handler) handleCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	if err := h.store.CancelUserDeletion(userId); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to cancel deletion: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "account deletion cancelled"})
+}
@@ -1,15 +1,19 @@
 package user
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/izumii.cxde/blog-api/mail"
 	"github.com/izumii.cxde/blog-api/service/auth"
+	"github.com/izumii.cxde/blog-api/service/blog"
 	"github.com/izumii.cxde/blog-api/types"
 	"github.com/izumii.cxde/blog-api/utils"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Store struct {
@@ -29,6 +33,478 @@ func (s *Store) SendVerificationCode(email, otp, username string) error {
 	return nil
 }
 
+// SendPasswordResetLink emails the password reset link to the user
+func (s *Store) SendPasswordResetLink(email, link, username string, expiresIn time.Duration) error {
+	if err := mail.SendPasswordResetMail(link, email, username, expiresIn); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+/*
+CreatePasswordResetToken stores a new reset token for the user, replacing any unused one
+so only the latest link works
+@params: tokenHash - the hash of the token sent to the user
+*/
+func (s *Store) CreatePasswordResetToken(userId int64, tokenHash string, expiresAt time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND used_at IS NULL", userId).Delete(&types.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&types.PasswordResetToken{
+			UserID:    uint(userId),
+			TokenHash: tokenHash,
+			ExpiresAt: expiresAt,
+		}).Error
+	})
+}
+
+/*
+ResetPassword sets a new password using a reset token. the token is used up, and the
+user's token version is bumped so every existing session is logged out
+@params: tokenHash - the hash of the token from the link, password - the new password in plain text
+*/
+func (s *Store) ResetPassword(tokenHash, password string) error {
+	hashedPassword, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var t types.PasswordResetToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, time.Now()).
+			First(&t).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("invalid or expired token")
+			}
+			return err
+		}
+
+		if err := tx.Model(&t).Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		if err := revokeUserTokens(tx, t.UserID); err != nil {
+			return err
+		}
+		res := tx.Model(&types.User{}).Where("id = ?", t.UserID).Updates(map[string]any{
+			"password":      hashedPassword,
+			"token_version": gorm.Expr("token_version + 1"),
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("invalid or expired token")
+		}
+		return nil
+	})
+}
+
+// SendEmailChangeConfirmation emails the confirmation link to the new address
+func (s *Store) SendEmailChangeConfirmation(email, link, username string, expiresIn time.Duration) error {
+	if err := mail.SendEmailChangeConfirmation(link, email, username, expiresIn); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+// SendEmailChangeNotice emails the undo link to the old address
+func (s *Store) SendEmailChangeNotice(email, undoLink, username, newEmail string) error {
+	if err := mail.SendEmailChangeNotice(undoLink, email, username, newEmail); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+// CreateEmailChange stores a new email change, cancelling the user's other pending ones
+func (s *Store) CreateEmailChange(change *types.EmailChange) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND confirmed_at IS NULL AND undone_at IS NULL", change.UserID).
+			Delete(&types.EmailChange{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(change).Error
+	})
+}
+
+// emailTaken reports whether another user already has the email
+func emailTaken(tx *gorm.DB, email string, userId uint) (bool, error) {
+	var count int64
+	err := tx.Unscoped().Model(&types.User{}).Where("email = ? AND id <> ?", email, userId).Count(&count).Error
+	return count > 0, err
+}
+
+/*
+ConfirmEmailChange commits the new email of a pending change. the email is checked again
+here, as someone may have registered with it since the change was requested
+@params: tokenHash - the hash of the token from the confirmation link
+*/
+func (s *Store) ConfirmEmailChange(tokenHash string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var c types.EmailChange
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("confirm_token_hash = ? AND confirmed_at IS NULL AND undone_at IS NULL AND expires_at > ?", tokenHash, time.Now()).
+			First(&c).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("invalid or expired token")
+			}
+			return err
+		}
+
+		taken, err := emailTaken(tx, c.NewEmail, c.UserID)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return fmt.Errorf("email is already in use")
+		}
+		// the unique index still has the final say if two changes race past the check
+		res := tx.Model(&types.User{}).Where("id = ? AND email = ?", c.UserID, c.OldEmail).Update("email", c.NewEmail)
+		if res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrDuplicatedKey) || strings.Contains(res.Error.Error(), "duplicate key") {
+				return fmt.Errorf("email is already in use")
+			}
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("the email of the account changed since this was requested")
+		}
+		return tx.Model(&c).Update("confirmed_at", time.Now()).Error
+	})
+}
+
+/*
+UndoEmailChange cancels an email change from the old address. when it was already confirmed the
+old email is put back, and since the account may have been taken over it is logged out everywhere
+@params: tokenHash - the hash of the token from the undo link
+*/
+func (s *Store) UndoEmailChange(tokenHash string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var c types.EmailChange
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("undo_token_hash = ? AND undone_at IS NULL AND undo_expires_at > ?", tokenHash, time.Now()).
+			First(&c).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("invalid or expired token")
+			}
+			return err
+		}
+
+		if c.ConfirmedAt != nil {
+			taken, err := emailTaken(tx, c.OldEmail, c.UserID)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return fmt.Errorf("the old email is now used by another account, please contact support")
+			}
+			if err := tx.Model(&types.User{}).Where("id = ?", c.UserID).Update("email", c.OldEmail).Error; err != nil {
+				return err
+			}
+			if err := revokeUserTokens(tx, c.UserID); err != nil {
+				return err
+			}
+			err = tx.Model(&types.User{}).Where("id = ?", c.UserID).
+				Update("token_version", gorm.Expr("token_version + 1")).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(&c).Update("undone_at", time.Now()).Error
+	})
+}
+
+// errRefreshTokenReused is returned when an already used refresh token is presented again
+var errRefreshTokenReused = errors.New("refresh token reuse detected, please log in again")
+
+/*
+CreateRefreshToken stores the first refresh token of a new login
+@params: familyId - identifies the login, tokenHash - the hash of the token given to the user
+*/
+func (s *Store) CreateRefreshToken(userId int64, familyId, tokenHash string, expiresAt time.Time) error {
+	return s.db.Create(&types.RefreshToken{
+		UserID:    uint(userId),
+		FamilyID:  familyId,
+		TokenHash: tokenHash,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+/*
+RotateRefreshToken uses up a refresh token and stores its replacement in the same family.
+when the token was already used the whole family is revoked, as one of the two copies was stolen
+@params: tokenHash - the hash of the presented token, newTokenHash - the hash of its replacement
+@returns: the new refresh token
+*/
+func (s *Store) RotateRefreshToken(tokenHash, newTokenHash string, expiresAt time.Time) (*types.RefreshToken, error) {
+	var (
+		next   types.RefreshToken
+		reused string
+	)
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var t types.RefreshToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token_hash = ?", tokenHash).First(&t).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("invalid refresh token")
+			}
+			return err
+		}
+		if t.RevokedAt != nil || t.ExpiresAt.Before(time.Now()) {
+			return fmt.Errorf("invalid refresh token")
+		}
+		if t.UsedAt != nil {
+			// revoked after this transaction, so the revocation isn't rolled back with it
+			reused = t.FamilyID
+			return nil
+		}
+
+		if err := tx.Model(&t).Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		next = types.RefreshToken{
+			UserID:    t.UserID,
+			FamilyID:  t.FamilyID,
+			TokenHash: newTokenHash,
+			ExpiresAt: expiresAt,
+		}
+		return tx.Create(&next).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused != "" {
+		if err := s.RevokeRefreshTokenFamily(reused); err != nil {
+			return nil, err
+		}
+		return nil, errRefreshTokenReused
+	}
+	return &next, nil
+}
+
+// GetRefreshToken gets a refresh token by its hash
+func (s *Store) GetRefreshToken(tokenHash string) (*types.RefreshToken, error) {
+	var t types.RefreshToken
+	res := s.db.First(&t, "token_hash = ?", tokenHash)
+	return &t, res.Error
+}
+
+// RevokeRefreshTokenFamily logs out a single login, ending its session
+func (s *Store) RevokeRefreshTokenFamily(familyId string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&types.RefreshToken{}, &types.Session{}} {
+			err := tx.Model(model).
+				Where("family_id = ? AND revoked_at IS NULL", familyId).
+				Update("revoked_at", time.Now()).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// revokeUserTokens revokes every refresh token and session of the user
+func revokeUserTokens(tx *gorm.DB, userId uint) error {
+	for _, model := range []any{&types.RefreshToken{}, &types.Session{}} {
+		err := tx.Model(model).
+			Where("user_id = ? AND revoked_at IS NULL", userId).
+			Update("revoked_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeAllRefreshTokens logs the user out everywhere, including the access tokens already handed out
+func (s *Store) RevokeAllRefreshTokens(userId int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := revokeUserTokens(tx, uint(userId)); err != nil {
+			return err
+		}
+		return tx.Model(&types.User{}).Where("id = ?", userId).
+			Update("token_version", gorm.Expr("token_version + 1")).Error
+	})
+}
+
+// CreateSession records a new login
+func (s *Store) CreateSession(session *types.Session) error {
+	return s.db.Create(session).Error
+}
+
+// GetSessions returns the active sessions of the user, most recently used first
+func (s *Store) GetSessions(userId int64) (*[]types.Session, error) {
+	var sessions []types.Session
+	err := s.db.Where("user_id = ? AND revoked_at IS NULL", userId).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return &sessions, nil
+}
+
+// GetActiveSession gets the session of a refresh token family, unless it has been revoked
+func (s *Store) GetActiveSession(userId int64, familyId string) (*types.Session, error) {
+	var session types.Session
+	res := s.db.First(&session, "user_id = ? AND family_id = ? AND revoked_at IS NULL", userId, familyId)
+	return &session, res.Error
+}
+
+// TouchSession sets the last seen time of a session to now
+func (s *Store) TouchSession(id uint) error {
+	return s.db.Model(&types.Session{}).Where("id = ?", id).Update("last_seen_at", time.Now()).Error
+}
+
+/*
+RevokeSession logs out one of the user's sessions, along with its refresh tokens
+@params: userId - the owner of the session, id - the id of the session
+*/
+func (s *Store) RevokeSession(userId int64, id uint) error {
+	var session types.Session
+	err := s.db.First(&session, "id = ? AND user_id = ? AND revoked_at IS NULL", id, userId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("session not found")
+		}
+		return err
+	}
+	return s.RevokeRefreshTokenFamily(session.FamilyID)
+}
+
+// GetSession returns one of the user's sessions that is still logged in
+func (s *Store) GetSession(userId int64, id uint) (*types.Session, error) {
+	var session types.Session
+	res := s.db.First(&session, "id = ? AND user_id = ? AND revoked_at IS NULL", id, userId)
+	return &session, res.Error
+}
+
+/*
+ReauthenticateSession records that the user of the session just logged in again through a provider
+@params: userId - the user the provider's identity is linked to, id - the session to mark
+*/
+func (s *Store) ReauthenticateSession(userId int64, id uint) error {
+	res := s.db.Model(&types.Session{}).Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userId).
+		Update("reauthenticated_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("the account is not linked to the logged in user")
+	}
+	return nil
+}
+
+/*
+SearchUsers returns a page of users matching the options, newest first
+@params: opts - the query (name or email), role and suspension filters and the page
+*/
+func (s *Store) SearchUsers(opts types.UserSearchOptions) (*types.UserPage, error) {
+	query := s.db.Model(&types.User{})
+	if opts.Query != "" {
+		like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(opts.Query) + "%"
+		query = query.Where("first_name ILIKE ? OR last_name ILIKE ? OR email ILIKE ? OR CONCAT(first_name, ' ', last_name) ILIKE ?", like, like, like, like)
+	}
+	if opts.Role != "" {
+		query = query.Where("role = ?", opts.Role)
+	}
+	if opts.Suspended != nil {
+		if *opts.Suspended {
+			query = query.Where("suspended_at IS NOT NULL")
+		} else {
+			query = query.Where("suspended_at IS NULL")
+		}
+	}
+
+	var page types.UserPage
+	if err := query.Session(&gorm.Session{}).Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+	if err := query.Order("id DESC").Limit(opts.Limit).Offset(opts.Offset).Find(&page.Data).Error; err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+/*
+SetUserSuspended suspends or unsuspends a user. suspending also ends all of the user's sessions
+@params: reason - shown to the admins, ignored when unsuspending
+*/
+func (s *Store) SetUserSuspended(id int64, suspended bool, reason string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		fields := map[string]any{"suspended_at": nil, "suspend_reason": ""}
+		if suspended {
+			fields = map[string]any{"suspended_at": time.Now(), "suspend_reason": reason}
+		}
+		res := tx.Model(&types.User{}).Where("id = ?", id).Updates(fields)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("user not found")
+		}
+		if !suspended {
+			return nil
+		}
+		return revokeUserTokens(tx, uint(id))
+	})
+}
+
+// RequireReverification marks the user as unverified, they have to verify their email again
+func (s *Store) RequireReverification(id int64) error {
+	res := s.db.Model(&types.User{}).Where("id = ?", id).
+		Updates(map[string]any{"verified": false, "otp": "", "otp_expiration": time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// SetUserRole changes the role of a user
+func (s *Store) SetUserRole(id int64, role types.Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("invalid role: %s", role)
+	}
+	res := s.db.Model(&types.User{}).Where("id = ?", id).Update("role", role)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// CreateAuditLog records an admin action
+func (s *Store) CreateAuditLog(entry types.AuditLog) error {
+	return s.db.Create(&entry).Error
+}
+
+/*
+GetAuditLogs returns the audit trail, newest first
+@params: targetUserId - only the actions on this user, or every action when 0
+*/
+func (s *Store) GetAuditLogs(targetUserId int64, limit, offset int) (*[]types.AuditLog, error) {
+	query := s.db.Model(&types.AuditLog{})
+	if targetUserId != 0 {
+		query = query.Where("target_user_id = ?", targetUserId)
+	}
+	var logs []types.AuditLog
+	if err := query.Order("id DESC").Limit(limit).Offset(offset).Find(&logs).Error; err != nil {
+		return nil, err
+	}
+	return &logs, nil
+}
+
 // GetUserByEmail gets a user by their email address
 func (s *Store) GetUserByEmail(email string) (*types.User, error) {
 	var u types.User
@@ -81,8 +557,7 @@ func (s *Store) UpdateUserById(id int64, u types.User) error {
 		return errs.(validator.ValidationErrors)
 	}
 
-	// Use `Select` to include all fields explicitly
-	u.Otp = "0"
+	// Updates only writes the non zero fields of u
 	res := s.db.Model(&types.User{}).
 		Where("id = ?", id).
 		Updates(u)
@@ -90,12 +565,513 @@ func (s *Store) UpdateUserById(id int64, u types.User) error {
 	if res.Error != nil {
 		return res.Error
 	}
-	if res.Error.Error() == "record not found" {
-		return fmt.Errorf("blog not found")
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+/*
+UpdateProfile changes the profile fields that are set in the payload
+@params: id - the id of the user, p - the fields to change
+@returns: the updated user
+*/
+func (s *Store) UpdateProfile(id int64, p types.UpdateProfilePayload) (*types.User, error) {
+	fields := map[string]any{}
+	for column, value := range map[string]*string{
+		"first_name": p.FirstName,
+		"last_name":  p.LastName,
+		"avatar_url": p.AvatarUrl,
+		"bio":        p.Bio,
+		"website":    p.Website,
+	} {
+		if value != nil {
+			fields[column] = *value
+		}
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if len(fields) > 0 {
+			res := tx.Model(&types.User{}).Where("id = ?", id).Updates(fields)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return fmt.Errorf("user not found")
+			}
+		}
+		if p.SocialLinks != nil {
+			// the links go through the struct so the json serializer of the column runs
+			u := types.User{SocialLinks: p.SocialLinks}
+			return tx.Model(&u).Where("id = ?", id).Select("social_links").Updates(&u).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetUserById(id)
+}
+
+/*
+DeleteUserById deletes an account. everything private to it (bookmarks, reading lists, logins) is
+deleted, and the user row is scrubbed of anything identifying before it is soft deleted. the row is
+kept so whatever content is left behind still points to a user
+@params:
+id - the id of the user
+content - types.DeletionRemove also deletes the user's blogs, comments and reactions,
+types.DeletionAnonymise leaves them credited to the anonymous user
+*/
+func (s *Store) DeleteUserById(id int64, content string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var u types.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&u, id).Error; err != nil {
+			return err
+		}
+		if content == types.DeletionRemove {
+			if err := removeUserContent(tx, id); err != nil {
+				return err
+			}
+		}
+
+		lists := tx.Model(&types.ReadingList{}).Select("id").Where("user_id = ?", id)
+		steps := []struct {
+			model any
+			query string
+			args  []any
+		}{
+			{&types.ReadingListItem{}, "reading_list_id IN (?)", []any{lists}},
+			{&types.ReadingList{}, "user_id = ?", []any{id}},
+			{&types.Bookmark{}, "user_id = ?", []any{id}},
+			{&types.Session{}, "user_id = ?", []any{id}},
+			{&types.RefreshToken{}, "user_id = ?", []any{id}},
+			{&types.PasswordResetToken{}, "user_id = ?", []any{id}},
+			{&types.EmailChange{}, "user_id = ?", []any{id}},
+			{&types.RecoveryCode{}, "user_id = ?", []any{id}},
+			{&types.LoginChallenge{}, "user_id = ?", []any{id}},
+			{&types.ExternalIdentity{}, "user_id = ?", []any{id}},
+			{&types.OAuthState{}, "link_user_id = ?", []any{id}},
+		}
+		for _, step := range steps {
+			if err := tx.Where(step.query, step.args...).Delete(step.model).Error; err != nil {
+				return err
+			}
+		}
+
+		anonymous := types.User{
+			FirstName: "Deleted",
+			LastName:  "user",
+			// keeps the unique index happy and frees the real address for a new account
+			Email:        fmt.Sprintf("deleted-%d@deleted.invalid", id),
+			TokenVersion: u.TokenVersion + 1,
+		}
+		err := tx.Model(&u).Select("first_name", "last_name", "email", "password", "avatar_url", "bio",
+			"website", "social_links", "otp", "suspend_reason", "deletion_scheduled_at", "deletion_content",
+			"token_version", "totp_secret", "totp_enabled").Updates(&anonymous).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&u).Error
+	})
+}
+
+// removeUserContent deletes the blogs and reactions of a user, and empties their comments
+func removeUserContent(tx *gorm.DB, id int64) error {
+	// take the user's reactions back out of the counts and comment scores first
+	err := tx.Exec(`UPDATE reaction_counts rc SET count = rc.count - 1 FROM reactions r
+		WHERE r.user_id = ? AND rc.target_type = r.target_type AND rc.target_id = r.target_id AND rc.type = r.type`, id).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Exec(`UPDATE comments c SET score = c.score - 1 FROM reactions r
+		WHERE r.user_id = ? AND r.target_type = ? AND r.target_id = c.id`, id, types.ReactionTargetComment).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ?", id).Delete(&types.Reaction{}).Error; err != nil {
+		return err
+	}
+
+	var ids []uint
+	if err := tx.Unscoped().Model(&types.Blog{}).Where("user_id = ?", id).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		if err := blog.PurgeBlogs(tx, ids); err != nil {
+			return err
+		}
+	}
+
+	// comments on other blogs become the placeholders deleted comments leave in their thread
+	return tx.Unscoped().Model(&types.Comment{}).Where("user_id = ?", id).Updates(map[string]any{
+		"body":       "",
+		"deleted_at": gorm.Expr("COALESCE(deleted_at, ?)", time.Now()),
+	}).Error
+}
+
+// ScheduleUserDeletion marks the account to be deleted at the given time, see DeleteUserById
+func (s *Store) ScheduleUserDeletion(id int64, at time.Time, content string) error {
+	return s.db.Model(&types.User{}).Where("id = ?", id).Updates(map[string]any{
+		"deletion_scheduled_at": at,
+		"deletion_content":      content,
+	}).Error
+}
+
+// CancelUserDeletion keeps an account that was scheduled to be deleted
+func (s *Store) CancelUserDeletion(id int64) error {
+	res := s.db.Model(&types.User{}).Where("id = ? AND deletion_scheduled_at IS NOT NULL", id).Updates(map[string]any{
+		"deletion_scheduled_at": nil,
+		"deletion_content":      "",
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("the account is not scheduled for deletion")
+	}
+	return nil
+}
+
+/*
+DeleteScheduledUsers deletes every account whose deletion was scheduled at or before the given time
+@returns: the number of deleted accounts, error
+*/
+func (s *Store) DeleteScheduledUsers(before time.Time) (int64, error) {
+	var users []types.User
+	err := s.db.Select("id", "deletion_content").
+		Where("deletion_scheduled_at IS NOT NULL AND deletion_scheduled_at <= ?", before).
+		Find(&users).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, u := range users {
+		if err := s.DeleteUserById(int64(u.ID), u.DeletionContent); err != nil {
+			return n, fmt.Errorf("failed to delete user %d: %w", u.ID, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// GetUserExport collects everything stored about a user, including deleted blogs and comments
+func (s *Store) GetUserExport(id int64) (*types.UserExport, error) {
+	var e types.UserExport
+	if err := s.db.First(&e.User, id).Error; err != nil {
+		return nil, err
+	}
+	err := s.db.Unscoped().Preload("Tags").Preload("Category").
+		Where("user_id = ?", id).Order("id").Find(&e.Blogs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	e.Tags = []string{}
+	for _, b := range e.Blogs {
+		for _, t := range b.Tags {
+			if !seen[t.Name] {
+				seen[t.Name] = true
+				e.Tags = append(e.Tags, t.Name)
+			}
+		}
+	}
+
+	queries := []struct {
+		dest  any
+		query *gorm.DB
+	}{
+		{&e.Sessions, s.db.Order("id")},
+		{&e.Identities, s.db.Order("id")},
+		{&e.Comments, s.db.Unscoped().Order("id")},
+		{&e.Reactions, s.db.Order("id")},
+		{&e.Bookmarks, s.db.Preload("Blog").Order("id")},
+		{&e.ReadingLists, s.db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+			return db.Order("position")
+		}).Order("id")},
+	}
+	for _, q := range queries {
+		if err := q.query.Where("user_id = ?", id).Find(q.dest).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &e, nil
+}
+
+// SetTOTPSecret starts a two-factor enrollment with a new secret. it is not used until EnableTOTP
+func (s *Store) SetTOTPSecret(userId int64, secret string) error {
+	res := s.db.Model(&types.User{}).Where("id = ? AND totp_enabled = ?", userId, false).Update("totp_secret", secret)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("two-factor authentication is already enabled")
+	}
+	return nil
+}
+
+/*
+EnableTOTP turns on two-factor authentication once the user proved they can produce codes for the secret
+@params:
+step - the time step of the code that confirmed the enrollment, so it can't be used to log in
+recoveryCodeHashes - the hashes of the user's new recovery codes
+challengeId - the login challenge the enrollment answers, spent in the same transaction. 0 for logged in users
+*/
+func (s *Store) EnableTOTP(userId int64, step int64, recoveryCodeHashes []string, challengeId uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if challengeId != 0 {
+			if err := useLoginChallenge(tx, challengeId); err != nil {
+				return err
+			}
+		}
+		res := tx.Model(&types.User{}).Where("id = ? AND totp_enabled = ? AND totp_secret <> ''", userId, false).
+			Updates(map[string]any{"totp_enabled": true, "totp_last_step": step})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("two-factor authentication is already enabled")
+		}
+		return replaceRecoveryCodes(tx, userId, recoveryCodeHashes)
+	})
+}
+
+// DisableTOTP turns off two-factor authentication and deletes the recovery codes
+func (s *Store) DisableTOTP(userId int64) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&types.User{}).Where("id = ?", userId).
+			Updates(map[string]any{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userId).Delete(&types.RecoveryCode{}).Error
+	})
+}
+
+// UseTOTPStep records the time step of an accepted code. a code from the same or an earlier step is refused
+func (s *Store) UseTOTPStep(userId int64, step int64) error {
+	res := s.db.Model(&types.User{}).Where("id = ? AND totp_last_step < ?", userId, step).Update("totp_last_step", step)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("code has already been used")
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes swaps the user's recovery codes for new ones
+func (s *Store) ReplaceRecoveryCodes(userId int64, codeHashes []string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userId, codeHashes)
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userId int64, codeHashes []string) error {
+	if err := tx.Where("user_id = ?", userId).Delete(&types.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	codes := make([]types.RecoveryCode, 0, len(codeHashes))
+	for _, h := range codeHashes {
+		codes = append(codes, types.RecoveryCode{UserID: uint(userId), CodeHash: h})
+	}
+	return tx.Create(&codes).Error
+}
+
+// UseRecoveryCode spends one of the user's recovery codes
+func (s *Store) UseRecoveryCode(userId int64, codeHash string) error {
+	res := s.db.Model(&types.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userId, codeHash).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("invalid recovery code")
+	}
+	return nil
+}
+
+func (s *Store) CreateLoginChallenge(c *types.LoginChallenge) error {
+	return s.db.Create(c).Error
+}
+
+// GetLoginChallenge returns the challenge of the token, if it can still be answered
+func (s *Store) GetLoginChallenge(tokenHash string) (*types.LoginChallenge, error) {
+	var c types.LoginChallenge
+	err := s.db.Where("token_hash = ? AND used_at IS NULL AND expires_at > ? AND attempts < ?",
+		tokenHash, time.Now(), types.MaxLoginChallengeAttempts).First(&c).Error
+	if err != nil {
+		return nil, fmt.Errorf("invalid or expired challenge")
+	}
+	return &c, nil
+}
+
+// FailLoginChallenge counts a wrong code. the challenge stops working after MaxLoginChallengeAttempts
+func (s *Store) FailLoginChallenge(id uint) error {
+	return s.db.Model(&types.LoginChallenge{}).Where("id = ?", id).
+		Update("attempts", gorm.Expr("attempts + 1")).Error
+}
+
+// UseLoginChallenge marks the challenge as answered, failing if another request answered it first
+func (s *Store) UseLoginChallenge(id uint) error {
+	return useLoginChallenge(s.db, id)
+}
+
+func useLoginChallenge(tx *gorm.DB, id uint) error {
+	res := tx.Model(&types.LoginChallenge{}).Where("id = ? AND used_at IS NULL", id).Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("invalid or expired challenge")
 	}
 	return nil
 }
 
-func (s *Store) DeleteUserById(id int64) error {
-	return s.db.Delete(&types.User{}, id).Error
+// GetRoleSettings returns the settings of every role, with the defaults for roles that were never changed
+func (s *Store) GetRoleSettings() (*[]types.RoleSetting, error) {
+	var saved []types.RoleSetting
+	if err := s.db.Find(&saved).Error; err != nil {
+		return nil, err
+	}
+	byRole := make(map[types.Role]types.RoleSetting, len(saved))
+	for _, rs := range saved {
+		byRole[rs.Role] = rs
+	}
+
+	settings := []types.RoleSetting{}
+	for _, role := range []types.Role{types.RoleReader, types.RoleAuthor, types.RoleEditor, types.RoleAdmin} {
+		rs, ok := byRole[role]
+		if !ok {
+			rs = types.RoleSetting{Role: role}
+		}
+		settings = append(settings, rs)
+	}
+	return &settings, nil
+}
+
+// RoleRequiresTwoFactor reports whether users with the role must use two-factor authentication
+func (s *Store) RoleRequiresTwoFactor(role types.Role) (bool, error) {
+	var required []bool
+	err := s.db.Model(&types.RoleSetting{}).Where("role = ?", role).Pluck("require_two_factor", &required).Error
+	if err != nil {
+		return false, err
+	}
+	return len(required) > 0 && required[0], nil
+}
+
+func (s *Store) SetRoleRequiresTwoFactor(role types.Role, required bool) error {
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "role"}},
+		DoUpdates: clause.AssignmentColumns([]string{"require_two_factor", "updated_at"}),
+	}).Create(&types.RoleSetting{Role: role, RequireTwoFactor: required}).Error
+}
+
+func (s *Store) CreateOAuthState(state *types.OAuthState) error {
+	return s.db.Create(state).Error
+}
+
+// ConsumeOAuthState returns and deletes the login in progress for the state, so a callback works only once
+func (s *Store) ConsumeOAuthState(stateHash, provider string) (*types.OAuthState, error) {
+	var state types.OAuthState
+	res := s.db.Clauses(clause.Returning{}).
+		Where("state_hash = ? AND provider = ?", stateHash, provider).
+		Delete(&state)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 || state.ExpiresAt.Before(time.Now()) {
+		return nil, fmt.Errorf("invalid or expired state")
+	}
+	return &state, nil
+}
+
+// GetUserByIdentity returns the user an external identity is linked to
+func (s *Store) GetUserByIdentity(provider, subject string) (*types.User, error) {
+	var u types.User
+	err := s.db.Joins("JOIN external_identities ei ON ei.user_id = users.id").
+		Where("ei.provider = ? AND ei.subject = ?", provider, subject).
+		First(&u).Error
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+/*
+LinkIdentity links an external identity to its user
+@params: verifyAccount - the provider verified the user's email. an unverified account is then verified,
+and its password dropped, since whoever registered it without verifying may not own the email
+*/
+func (s *Store) LinkIdentity(identity types.ExternalIdentity, verifyAccount bool) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&identity).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) || strings.Contains(err.Error(), "duplicate key") {
+				return fmt.Errorf("this %s account is already linked", identity.Provider)
+			}
+			return err
+		}
+		if !verifyAccount {
+			return nil
+		}
+		res := tx.Model(&types.User{}).Where("id = ? AND verified = ?", identity.UserID, false).
+			Updates(map[string]any{"verified": true, "password": "", "token_version": gorm.Expr("token_version + 1")})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		return revokeUserTokens(tx, identity.UserID)
+	})
+}
+
+// CreateOAuthUser registers a user from a social login, linked to the identity they signed in with
+func (s *Store) CreateOAuthUser(u types.User, identity types.ExternalIdentity) (*types.User, error) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&u).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) || strings.Contains(err.Error(), "duplicate key") {
+				return fmt.Errorf("email is already in use")
+			}
+			return err
+		}
+		identity.UserID = u.ID
+		return tx.Create(&identity).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *Store) GetIdentities(userId int64) (*[]types.ExternalIdentity, error) {
+	var identities []types.ExternalIdentity
+	if err := s.db.Where("user_id = ?", userId).Order("id").Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	return &identities, nil
+}
+
+// DeleteIdentity unlinks an identity, unless it is the last way the user can log in
+func (s *Store) DeleteIdentity(userId int64, id uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var u types.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&u, userId).Error; err != nil {
+			return err
+		}
+		var others int64
+		if err := tx.Model(&types.ExternalIdentity{}).Where("user_id = ? AND id <> ?", userId, id).Count(&others).Error; err != nil {
+			return err
+		}
+		if u.Password == "" && others == 0 {
+			return fmt.Errorf("set a password before unlinking your last login provider")
+		}
+
+		res := tx.Where("user_id = ? AND id = ?", userId, id).Delete(&types.ExternalIdentity{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("no identity found")
+		}
+		return nil
+	})
 }
@@ -0,0 +1,321 @@
+package user
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/izumii.cxde/blog-api/service/auth"
+	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
+)
+
+// how long the second step of a login can take, and how many recovery codes a user gets
+const (
+	loginChallengeTTL = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// twoFactorRequired reports whether the user has to pass a second factor to log in
+func (h *Handler) twoFactorRequired(u *types.User) (bool, error) {
+	if u.TOTPEnabled {
+		return true, nil
+	}
+	return h.store.RoleRequiresTwoFactor(u.Role)
+}
+
+// startLoginChallenge answers a login with a correct password with a challenge token for the second step
+func (h *Handler) startLoginChallenge(w http.ResponseWriter, u *types.User) {
+	token, err := auth.GenerateToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate token: %w", err))
+		return
+	}
+	c := types.LoginChallenge{
+		UserID:    u.ID,
+		TokenHash: auth.HashToken(token),
+		ExpiresAt: time.Now().Add(loginChallengeTTL),
+	}
+	if err := h.store.CreateLoginChallenge(&c); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to save challenge: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message":         "two-factor authentication required",
+		"challenge_token": token,
+		// the role requires 2FA but the user has not set it up yet, see handleLoginTwoFactorSetup
+		"setup_required": !u.TOTPEnabled,
+	})
+}
+
+// challengeUser returns the challenge of the token and the user logging in with it
+func (h *Handler) challengeUser(token string) (*types.LoginChallenge, *types.User, error) {
+	c, err := h.store.GetLoginChallenge(auth.HashToken(token))
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := h.store.GetUserById(int64(c.UserID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid or expired challenge")
+	}
+	if u.SuspendedAt != nil {
+		return nil, nil, fmt.Errorf("account suspended")
+	}
+	return c, u, nil
+}
+
+// verifySecondFactor checks a code from the authenticator app or a recovery code. both work only once
+func (h *Handler) verifySecondFactor(u *types.User, p types.TwoFactorCodePayload) error {
+	if p.Code == "" {
+		return h.store.UseRecoveryCode(int64(u.ID), auth.HashRecoveryCode(p.RecoveryCode))
+	}
+	step, ok := auth.ValidateTOTP(u.TOTPSecret, p.Code)
+	if !ok {
+		return fmt.Errorf("invalid code")
+	}
+	return h.store.UseTOTPStep(int64(u.ID), step)
+}
+
+/*
+enableTwoFactor finishes an enrollment with a code for the pending secret
+@params: challengeId - the login challenge the code answers, spent together with enabling. 0 for logged in users
+@returns: the new recovery codes, shown to the user this one time
+*/
+func (h *Handler) enableTwoFactor(u *types.User, code string, challengeId uint) ([]string, error) {
+	if u.TOTPSecret == "" {
+		return nil, fmt.Errorf("start the two-factor setup first")
+	}
+	step, ok := auth.ValidateTOTP(u.TOTPSecret, code)
+	if !ok {
+		return nil, fmt.Errorf("invalid code")
+	}
+	codes, hashes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.store.EnableTOTP(int64(u.ID), step, hashes, challengeId); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// beginSetup generates a new secret for the user and saves it as their pending enrollment
+func (h *Handler) beginSetup(w http.ResponseWriter, u *types.User) {
+	if u.TOTPEnabled {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("two-factor authentication is already enabled"))
+		return
+	}
+	setup, err := auth.NewTOTPSetup(u.Email)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate secret: %w", err))
+		return
+	}
+	if err := h.store.SetTOTPSecret(int64(u.ID), setup.Secret); err != nil {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("failed to start setup: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, setup)
+}
+
+/*
+handleLoginTwoFactor is the second step of a login: the challenge token from handleLogin and a code.
+users enrolling because their role requires 2FA confirm their setup here, and get their recovery codes
+*/
+func (h *Handler) handleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var p types.TwoFactorLoginPayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+	c, u, err := h.challengeUser(p.ChallengeToken)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	var recoveryCodes []string
+	switch {
+	case u.TOTPEnabled:
+		err = h.verifySecondFactor(u, p.TwoFactorCodePayload)
+	case p.Code == "":
+		err = fmt.Errorf("a code from the authenticator app is required to finish the setup")
+	default:
+		// the challenge is spent in the same transaction, so the recovery codes are never
+		// saved without this response showing them
+		recoveryCodes, err = h.enableTwoFactor(u, p.Code, c.ID)
+	}
+	if err != nil {
+		if err := h.store.FailLoginChallenge(c.ID); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to update challenge: %w", err))
+			return
+		}
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("two-factor authentication failed: %w", err))
+		return
+	}
+	if recoveryCodes == nil {
+		if err := h.store.UseLoginChallenge(c.ID); err != nil {
+			utils.WriteError(w, http.StatusUnauthorized, err)
+			return
+		}
+	}
+
+	if err := StartSession(w, r, h.store, *u, nil); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("auth failed: %w", err))
+		return
+	}
+	if recoveryCodes != nil {
+		utils.WriteJSON(w, http.StatusOK, map[string]any{
+			"message":        "two-factor authentication enabled, login successful",
+			"recovery_codes": recoveryCodes,
+		})
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "login successful"})
+}
+
+// handleLoginTwoFactorSetup starts the enrollment of a user logging in whose role requires 2FA
+func (h *Handler) handleLoginTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	var p struct {
+		ChallengeToken string `json:"challenge_token" validate:"required"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+	_, u, err := h.challengeUser(p.ChallengeToken)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+	h.beginSetup(w, u)
+}
+
+// handleTwoFactorSetup starts the enrollment of the logged in user. it is confirmed with handleTwoFactorConfirm
+func (h *Handler) handleTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	u, err := h.store.GetUserById(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	h.beginSetup(w, u)
+}
+
+// handleTwoFactorConfirm enables 2FA with a first code from the authenticator app and returns the recovery codes
+func (h *Handler) handleTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var p struct {
+		Code string `json:"code" validate:"required,numeric,len=6"`
+	}
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+	u, err := h.store.GetUserById(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+
+	codes, err := h.enableTwoFactor(u, p.Code, 0)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("failed to enable two-factor authentication: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]any{
+		"message":        "two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// handleRegenerateRecoveryCodes replaces the user's recovery codes, after checking a current code
+func (h *Handler) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var p types.TwoFactorCodePayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+	u, err := h.store.GetUserById(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	if !u.TOTPEnabled {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("two-factor authentication is not enabled"))
+		return
+	}
+	if err := h.verifySecondFactor(u, p); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	codes, hashes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to generate recovery codes: %w", err))
+		return
+	}
+	if err := h.store.ReplaceRecoveryCodes(userId, hashes); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to save recovery codes: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+}
+
+// handleDisableTwoFactor turns 2FA off with the password and a current code, unless the user's role requires it
+func (h *Handler) handleDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userId := r.Context().Value(types.UserIDKey).(int64)
+	var p types.DisableTwoFactorPayload
+	if err := utils.ParseJSON(r, &p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := utils.Validate.Struct(p); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request body %s", err.Error()))
+		return
+	}
+	u, err := h.store.GetUserById(userId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+	if !u.TOTPEnabled {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("two-factor authentication is not enabled"))
+		return
+	}
+	if required, err := h.store.RoleRequiresTwoFactor(u.Role); err != nil || required {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("two-factor authentication is required for %s accounts", u.Role))
+		return
+	}
+	// accounts without a password are confirmed by the second factor alone
+	if u.Password != "" && !auth.CompareHashPassword(u.Password, p.Password) {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid credentials"))
+		return
+	}
+	if err := h.verifySecondFactor(u, p.TwoFactorCodePayload); err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if err := h.store.DisableTOTP(userId); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("failed to disable two-factor authentication: %w", err))
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "two-factor authentication disabled"})
+}
@@ -2,9 +2,11 @@ package storage
 
 import (
 	"log/slog"
+	"strings"
 
 	"github.com/izumii.cxde/blog-api/config"
 	"github.com/izumii.cxde/blog-api/types"
+	"github.com/izumii.cxde/blog-api/utils"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -16,17 +18,114 @@ func NewPostgresStorage(cfg config.Config) (*gorm.DB, error) {
 		return nil, err
 	}
 
+	// blogs created before the status column existed were already public, so they
+	// are marked as published once the column is added instead of the draft default
+	hadStatus := db.Migrator().HasColumn(&types.Blog{}, "status")
+	// blogs used to store their category as free text in this column
+	hadTextCategory := db.Migrator().HasColumn(&types.Blog{}, "category")
+	// logins from before sessions were recorded only have their refresh tokens
+	hadSessions := db.Migrator().HasTable(&types.Session{})
+
 	if err = db.AutoMigrate(
 		&types.User{},
 		&types.Blog{},
 		&types.Tag{},
-		&types.BlogTag{}); err != nil {
+		&types.BlogTag{},
+		&types.BlogRevision{},
+		&types.BlogSlug{},
+		&types.Category{},
+		&types.Comment{},
+		&types.Reaction{},
+		&types.ReactionCount{},
+		&types.Bookmark{},
+		&types.ReadingList{},
+		&types.ReadingListItem{},
+		&types.PasswordResetToken{},
+		&types.RefreshToken{},
+		&types.Session{},
+		&types.AuditLog{},
+		&types.EmailChange{},
+		&types.RoleSetting{},
+		&types.RecoveryCode{},
+		&types.LoginChallenge{},
+		&types.ExternalIdentity{},
+		&types.OAuthState{}); err != nil {
 		slog.Error("failed to auto migrate: ", slog.String("error", err.Error()))
 		return db, err
 	} else {
 		slog.Info("database auto migrated successfully")
 	}
 
+	if !hadStatus {
+		if err := db.Model(&types.Blog{}).Unscoped().
+			Where("1 = 1").
+			Updates(map[string]any{"status": types.BlogStatusPublished, "published_at": gorm.Expr("created_at")}).Error; err != nil {
+			slog.Error("failed to backfill blog status: ", slog.String("error", err.Error()))
+			return db, err
+		}
+	}
+
+	if hadTextCategory {
+		if err := migrateTextCategories(db); err != nil {
+			slog.Error("failed to migrate blog categories: ", slog.String("error", err.Error()))
+			return db, err
+		}
+	}
+
+	if !hadSessions {
+		err := db.Exec(`INSERT INTO sessions (user_id, family_id, user_agent, ip, created_at, last_seen_at)
+			SELECT user_id, family_id, '', '', MIN(created_at), MAX(created_at) FROM refresh_tokens
+			WHERE revoked_at IS NULL GROUP BY user_id, family_id`).Error
+		if err != nil {
+			slog.Error("failed to backfill sessions: ", slog.String("error", err.Error()))
+			return db, err
+		}
+	}
+
+	// ADMIN_USER_IDS bootstraps the first admins, the rest are promoted through the api
+	if len(cfg.AdminUserIds) > 0 {
+		err := db.Model(&types.User{}).Where("id IN ?", cfg.AdminUserIds).Update("role", types.RoleAdmin).Error
+		if err != nil {
+			slog.Error("failed to promote admin users: ", slog.String("error", err.Error()))
+			return db, err
+		}
+	}
+
 	slog.Info("database opened successfully")
 	return db, nil
 }
+
+// migrateTextCategories moves the free text blog categories into the categories table.
+// spellings that slugify the same ("Golang", "golang ", "GoLang") become one category
+func migrateTextCategories(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var names []string
+		if err := tx.Table("blogs").Distinct("category").Where("category IS NOT NULL").Pluck("category", &names).Error; err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			slug := utils.Slugify(name)
+			if slug == "" {
+				slug = "uncategorized"
+			}
+			var c types.Category
+			if err := tx.Where(types.Category{Slug: slug}).
+				Attrs(types.Category{Name: strings.TrimSpace(name)}).
+				FirstOrCreate(&c).Error; err != nil {
+				return err
+			}
+			if err := tx.Table("blogs").Where("category = ?", name).Update("category_id", c.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&types.BlogRevision{}).Where("category = ?", name).Update("category_id", c.ID).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Migrator().DropColumn(&types.Blog{}, "category"); err != nil {
+			return err
+		}
+		// the search documents included the old column, they are rebuilt on startup
+		return tx.Table("blogs").Where("1 = 1").Update("search_vector", nil).Error
+	})
+}
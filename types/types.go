@@ -1,6 +1,8 @@
 package types
 
 import (
+	"encoding/json"
+	"slices"
 	"time"
 
 	"gorm.io/gorm"
@@ -11,15 +13,216 @@ type ContextKey string
 
 const UserIDKey ContextKey = "userId"
 
+// SessionIDKey holds the id (uint) of the session the request was authenticated with
+const SessionIDKey ContextKey = "sessionId"
+
+// UserRoleKey holds the Role of the authenticated user
+const UserRoleKey ContextKey = "userRole"
+
 // === === POST === ===
 type BlogStore interface {
 	CreateBlog(b Blog) error
-	GetAllBlogs() (*[]Blog, error)
+	GetAllBlogs(viewerId int64, opts BlogListOptions) (*BlogPage, error)
 	GetBlogById(id int64) (*Blog, error)
-	GetAllBlogsByUserId(userId int64, term string) (*[]Blog, error)
-	UpdateBlogById(userId, id int64, b Blog) error
+	GetBlogBySlug(slug string) (*Blog, error)
+	GetAllBlogsByUserId(userId, viewerId int64, opts BlogListOptions) (*BlogPage, error)
+	SearchBlogs(q string, limit, offset int) (*[]SearchResult, error)
+	UpdateBlogById(editor BlogEditor, id int64, b Blog, unschedule bool) error
+	UpdateBlogStatusById(editor BlogEditor, id int64, status BlogStatus) error
+	PublishDueBlogs(now time.Time) (int64, error)
 	SoftDeleteBlogById(userId, id int64) error
 	DeleteBlogPermanentlyById(userId, id int64) error
+	GetTrashedBlogs(userId int64) (*[]Blog, error)
+	RestoreBlogById(userId, id int64) error
+	PurgeDeletedBlogs(before time.Time) (int64, error)
+
+	GetBlogRevisions(editor BlogEditor, blogId int64) (*[]BlogRevision, error)
+	GetBlogRevisionById(editor BlogEditor, blogId, revisionId int64) (*BlogRevision, error)
+	RestoreBlogRevision(editor BlogEditor, blogId, revisionId int64) error
+
+	SetBlogCommentsLocked(userId, id int64, locked bool) error
+}
+
+// BlogStatus is the lifecycle state of a blog. Only published blogs are public.
+type BlogStatus string
+
+const (
+	BlogStatusDraft     BlogStatus = "draft"
+	BlogStatusPublished BlogStatus = "published"
+	BlogStatusArchived  BlogStatus = "archived"
+)
+
+// === === COMMENT === ===
+type CommentStore interface {
+	CreateComment(c Comment) (*Comment, error)
+	GetCommentById(id int64) (*Comment, error)
+	GetCommentsByBlogId(blogId int64, sort string, limit, offset int) (*CommentPage, error)
+	UpdateCommentById(userId, id int64, body string) error
+	SoftDeleteCommentById(id int64) error
+}
+
+// sort orders for comment threads
+const (
+	CommentSortOldest = "oldest"
+	CommentSortScore  = "score"
+)
+
+// Comment is a comment on a blog, or a reply to another comment when ParentID is set.
+// deleted comments keep their place in the thread with an empty body
+type Comment struct {
+	gorm.Model
+	BlogID   uint       `json:"blog_id" gorm:"index" validate:"-"`
+	UserID   uint       `json:"user_id" gorm:"index" validate:"-"`
+	ParentID *uint      `json:"parent_id" gorm:"index" validate:"-"`
+	ThreadID uint       `json:"thread_id" gorm:"index" validate:"-"` // id of the top level comment of the thread
+	Body     string     `json:"body" validate:"required,min=1,max=2000"`
+	Edited   bool       `json:"edited" gorm:"default:false" validate:"-"`
+	EditedAt *time.Time `json:"edited_at" validate:"-"`
+	Score    int64      `json:"score" gorm:"default:0;index" validate:"-"`
+	Deleted  bool       `json:"deleted" gorm:"-" validate:"-"`
+	Replies  []Comment  `json:"replies" gorm:"-" validate:"-"`
+}
+
+// CommentPage is a page of top level comments, each with its whole reply tree
+type CommentPage struct {
+	Data  []Comment `json:"data"`
+	Total int64     `json:"total"`
+}
+
+// === === REACTION === ===
+type ReactionStore interface {
+	ToggleReaction(target string, targetId, userId int64, t ReactionType) (*ReactionSummary, error)
+	GetReactionSummaries(target string, targetIds []uint, viewerId int64) (map[uint]*ReactionSummary, error)
+}
+
+// what a reaction is on
+const (
+	ReactionTargetBlog    = "blog"
+	ReactionTargetComment = "comment"
+)
+
+type ReactionType string
+
+// the fixed set of reactions
+const (
+	ReactionLike       ReactionType = "like"
+	ReactionLove       ReactionType = "love"
+	ReactionInsightful ReactionType = "insightful"
+	ReactionCelebrate  ReactionType = "celebrate"
+	ReactionCurious    ReactionType = "curious"
+)
+
+// Reaction is a user's reaction to a blog or comment. a user has at most one reaction per target
+type Reaction struct {
+	ID         uint         `json:"id" gorm:"primarykey"`
+	TargetType string       `json:"target_type" gorm:"type:varchar(20);uniqueIndex:idx_reaction_target_user"`
+	TargetID   uint         `json:"target_id" gorm:"uniqueIndex:idx_reaction_target_user"`
+	UserID     uint         `json:"user_id" gorm:"uniqueIndex:idx_reaction_target_user;index"`
+	Type       ReactionType `json:"type" gorm:"type:varchar(20)"`
+	CreatedAt  time.Time    `json:"created_at"`
+	UpdatedAt  time.Time    `json:"updated_at"`
+}
+
+// ReactionCount is the denormalised number of reactions of one type on a target,
+// kept in step with the Reaction rows in the same transaction
+type ReactionCount struct {
+	TargetType string       `gorm:"primaryKey;type:varchar(20)"`
+	TargetID   uint         `gorm:"primaryKey"`
+	Type       ReactionType `gorm:"primaryKey;type:varchar(20)"`
+	Count      int64        `gorm:"not null;default:0"`
+}
+
+// ReactionSummary is what clients see: the counts per reaction and the caller's own reaction
+type ReactionSummary struct {
+	Counts map[ReactionType]int64 `json:"counts"`
+	Mine   ReactionType           `json:"mine,omitempty"`
+}
+
+// === === BOOKMARK === ===
+type BookmarkStore interface {
+	AddBookmark(userId, blogId int64) error
+	RemoveBookmark(userId, blogId int64) error
+	GetBookmarks(viewer BlogEditor) (*[]Bookmark, error)
+
+	CreateReadingList(l ReadingList) (*ReadingList, error)
+	GetReadingLists(userId int64) (*[]ReadingList, error)
+	GetReadingListById(id int64) (*ReadingList, error)
+	GetReadingListByShareToken(token string) (*ReadingList, error)
+	UpdateReadingListById(userId, id int64, l ReadingList) error
+	DeleteReadingListById(userId, id int64) error
+	AddReadingListItem(userId, listId, blogId int64) error
+	RemoveReadingListItem(userId, listId, blogId int64) error
+	ReorderReadingList(userId, listId int64, blogIds []int64) error
+}
+
+// Bookmark is a blog a user saved for later. when the blog is deleted or
+// unpublished the bookmark stays, marked as unavailable
+type Bookmark struct {
+	ID          uint      `json:"id" gorm:"primarykey"`
+	UserID      uint      `json:"user_id" gorm:"uniqueIndex:idx_bookmark_user_blog"`
+	BlogID      uint      `json:"blog_id" gorm:"uniqueIndex:idx_bookmark_user_blog"`
+	Blog        *Blog     `json:"blog" gorm:"foreignKey:BlogID;constraint:OnDelete:CASCADE"`
+	Unavailable bool      `json:"unavailable" gorm:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ReadingList is a named, ordered list of blogs. public lists can be shared through their share token
+type ReadingList struct {
+	ID          uint              `json:"id" gorm:"primarykey"`
+	UserID      uint              `json:"user_id" gorm:"index" validate:"-"`
+	Name        string            `json:"name" validate:"required,min=1,max=100"`
+	Description string            `json:"description" validate:"max=500"`
+	Public      bool              `json:"public" gorm:"default:false"`
+	ShareToken  string            `json:"-" gorm:"uniqueIndex" validate:"-"`
+	ShareURL    string            `json:"share_url,omitempty" gorm:"-" validate:"-"` // only set on public lists
+	Items       []ReadingListItem `json:"items" gorm:"constraint:OnDelete:CASCADE" validate:"-"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+type ReadingListItem struct {
+	ID            uint      `json:"id" gorm:"primarykey"`
+	ReadingListID uint      `json:"reading_list_id" gorm:"uniqueIndex:idx_reading_list_blog"`
+	BlogID        uint      `json:"blog_id" gorm:"uniqueIndex:idx_reading_list_blog"`
+	Blog          *Blog     `json:"blog" gorm:"foreignKey:BlogID;constraint:OnDelete:CASCADE"`
+	Unavailable   bool      `json:"unavailable" gorm:"-"`
+	Position      int       `json:"position"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// === === CATEGORY === ===
+type CategoryStore interface {
+	GetAllCategories() (*[]Category, error)
+	GetCategoryBySlug(slug string) (*Category, error)
+	CreateCategory(c Category) (*Category, error)
+	UpdateCategoryBySlug(slug string, c Category, fields map[string]json.RawMessage) error
+	DeleteCategoryBySlug(slug string) error
+}
+
+// Category groups blogs. categories can be nested through ParentID
+type Category struct {
+	ID          uint       `json:"id" gorm:"primarykey"`
+	Name        string     `json:"name" validate:"required,min=3,max=255"`
+	Slug        string     `json:"slug" gorm:"uniqueIndex" validate:"omitempty,max=255"`
+	Description string     `json:"description" validate:"max=1000"`
+	ParentID    *uint      `json:"parent_id" gorm:"index" validate:"-"`
+	Children    []Category `json:"children,omitempty" gorm:"foreignKey:ParentID" validate:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// === === TAG === ===
+type TagStore interface {
+	GetAllTags() (*[]TagUsage, error)
+	RenameTag(name, newName string) error
+	MergeTags(name, into string) error
+	DeleteTag(name string) error
+}
+
+// TagUsage is a tag with the number of published blogs using it
+type TagUsage struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
 }
 
 type Tag struct {
@@ -36,40 +239,523 @@ type Blog struct {
 	gorm.Model
 	Title       string `json:"title" validate:"required,min=3,max=255"`
 	Description string `json:"description" validate:"required,min=3,max=500"`
-	Content     string `json:"content" validate:"required,min=3,max=3000"`
-	Category    string `json:"category" validate:"required,min=3,max=255"`
+	Content     string `json:"content" validate:"required,min=3,max=3000"` // markdown (CommonMark + GFM)
+	// Content rendered to sanitised html. it is rendered when the blog is written, never on read
+	ContentHTML string    `json:"content_html" validate:"-"`
+	CategoryID  uint      `json:"category_id" validate:"required"`
+	Category    *Category `json:"category,omitempty" gorm:"foreignKey:CategoryID" validate:"-"`
 	// tags are separated by commas for now. can validate to new table with many to many relation
 	Tags   []Tag `json:"tags" validate:"required" gorm:"many2many:blog_tags;"`
 	UserId uint  `json:"user_id" validate:"-"` // Foreign key reference
+	// new blogs start as drafts and are only listed publicly once published
+	Status      BlogStatus `json:"status" gorm:"type:varchar(20);default:draft;index" validate:"-"`
+	PublishedAt *time.Time `json:"published_at" validate:"-"`
+	// drafts with a publish_at in the past are published by the background publisher
+	PublishAt *time.Time `json:"publish_at" gorm:"index" validate:"-"`
+	// generated from the title. previous slugs are kept in BlogSlug so old links still resolve
+	Slug string `json:"slug" gorm:"uniqueIndex" validate:"-"`
+	// full-text search document, maintained by the store whenever the blog or its tags change
+	SearchVector string `json:"-" gorm:"type:tsvector;index:idx_blogs_search_vector,type:gin;->:false;<-:false" validate:"-"`
+	// aggregate reactions, filled in per request for the requesting user
+	Reactions *ReactionSummary `json:"reactions,omitempty" gorm:"-" validate:"-"`
+	// the author can lock comments, after which nobody can comment or edit their comments
+	CommentsLocked bool `json:"comments_locked" gorm:"default:false" validate:"-"`
 	// User   User  `gorm:"foreignKey:UserId"`           // Establish relationship
 }
 
+// sort orders for blog listings
+const (
+	BlogSortNewest    = "newest"
+	BlogSortOldest    = "oldest"
+	BlogSortUpdated   = "updated" // recently updated first
+	BlogSortTitle     = "title"
+	BlogSortPublished = "published" // recently published first
+)
+
+// BlogListOptions controls the page, order and filters of a blog listing
+type BlogListOptions struct {
+	Limit  int
+	Cursor string // opaque, taken from the next_cursor of the previous page
+	Sort   string
+
+	Category string // category slug, matches the category and all of its descendants
+	Tag      string
+	AuthorId int64
+	From     *time.Time // created at or after
+	To       *time.Time // created before
+	Term     string
+}
+
+// BlogPage is one page of a blog listing. NextCursor is empty on the last page
+type BlogPage struct {
+	Data       []Blog `json:"data"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// SearchResult is a blog matching a full-text search, with its rank and highlighted snippets.
+// matched words in the highlights are wrapped in <mark>, everything else is html escaped
+type SearchResult struct {
+	Blog           Blog    `json:"blog"`
+	Rank           float64 `json:"rank"`
+	TitleHighlight string  `json:"title_highlight"`
+	Snippet        string  `json:"snippet"`
+}
+
+// BlogSlug is a previous slug of a blog, kept so old permalinks redirect to the current one
+type BlogSlug struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	BlogID    uint      `json:"blog_id" gorm:"index"`
+	Slug      string    `json:"slug" gorm:"uniqueIndex"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlogRevision is an immutable snapshot of a blog, saved every time the blog is written
+type BlogRevision struct {
+	ID          uint      `json:"id" gorm:"primarykey"`
+	BlogID      uint      `json:"blog_id" gorm:"uniqueIndex:idx_blog_revision_version"`
+	Version     int       `json:"version" gorm:"uniqueIndex:idx_blog_revision_version"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Content     string    `json:"content"`
+	CategoryID  uint      `json:"category_id"`
+	Category    string    `json:"category"` // the category name at the time of the revision
+	Tags        []string  `json:"tags" gorm:"serializer:json"`
+	EditorID    uint      `json:"editor_id"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// DiffLine is a single line of a line-level diff.
+// Op is "=" for unchanged lines, "-" for removed lines and "+" for added lines
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+type RevisionDiff struct {
+	From   BlogRevision          `json:"from"`
+	To     BlogRevision          `json:"to"`
+	Fields map[string][]DiffLine `json:"fields"`
+}
+
 type VerificationPayload struct {
 	Email string `json:"email" validate:"required,email"`
 	Otp   string `json:"otp" validate:"required"`
 }
 
+// === === SITEMAP === ===
+type SitemapStore interface {
+	GetSitemapEntries() (*[]SitemapEntry, error)
+}
+
+// SitemapEntry is one url of the sitemap. Path is relative to the public host
+type SitemapEntry struct {
+	Path    string
+	LastMod time.Time
+}
+
+// === === ROLE === ===
+type Role string
+
+const (
+	RoleReader Role = "reader" // can comment, react and bookmark
+	RoleAuthor Role = "author" // can also write their own posts
+	RoleEditor Role = "editor" // can also edit and publish anyone's posts, and manage tags and categories
+	RoleAdmin  Role = "admin"  // can do everything, including managing users
+)
+
+type Permission string
+
+const (
+	PermissionWritePosts     Permission = "posts:write"
+	PermissionEditAnyPost    Permission = "posts:edit_any"
+	PermissionManageTaxonomy Permission = "taxonomy:manage"
+	PermissionManageUsers    Permission = "users:manage"
+)
+
+// RolePermissions lists what each role is allowed to do
+var RolePermissions = map[Role][]Permission{
+	RoleReader: {},
+	RoleAuthor: {PermissionWritePosts},
+	RoleEditor: {PermissionWritePosts, PermissionEditAnyPost, PermissionManageTaxonomy},
+	RoleAdmin:  {PermissionWritePosts, PermissionEditAnyPost, PermissionManageTaxonomy, PermissionManageUsers},
+}
+
+func (r Role) Valid() bool {
+	_, ok := RolePermissions[r]
+	return ok
+}
+
+// Can reports whether the role has the permission
+func (r Role) Can(p Permission) bool {
+	return slices.Contains(RolePermissions[r], p)
+}
+
+/*
+BlogEditor is the user changing a blog. only the owner may change a blog, unless
+AnyBlog is set for users allowed to edit anyone's posts
+*/
+type BlogEditor struct {
+	UserId  int64
+	AnyBlog bool
+}
+
+// CanView reports whether the user can see the blog. unpublished blogs are only visible
+// to their author and to the users who can edit them
+func (e BlogEditor) CanView(b *Blog) bool {
+	return b.Status == BlogStatusPublished || int64(b.UserId) == e.UserId || e.AnyBlog
+}
+
 // === === USER  === ===
 type UserStore interface {
 	GetUserByEmail(email string) (*User, error)
 	GetUserById(id int64) (*User, error)
+	UpdateProfile(id int64, p UpdateProfilePayload) (*User, error)
 	CreateUser(u RegisterUserPayload, otp string) error
 	UpdateUserById(id int64, u User) error
-	DeleteUserById(id int64) error
+	DeleteUserById(id int64, content string) error
+	ScheduleUserDeletion(id int64, at time.Time, content string) error
+	CancelUserDeletion(id int64) error
+	DeleteScheduledUsers(before time.Time) (int64, error)
+	GetUserExport(id int64) (*UserExport, error)
+	SetTOTPSecret(userId int64, secret string) error
+	EnableTOTP(userId int64, step int64, recoveryCodeHashes []string, challengeId uint) error
+	DisableTOTP(userId int64) error
+	UseTOTPStep(userId int64, step int64) error
+	ReplaceRecoveryCodes(userId int64, codeHashes []string) error
+	UseRecoveryCode(userId int64, codeHash string) error
+	CreateLoginChallenge(c *LoginChallenge) error
+	GetLoginChallenge(tokenHash string) (*LoginChallenge, error)
+	FailLoginChallenge(id uint) error
+	UseLoginChallenge(id uint) error
+	GetRoleSettings() (*[]RoleSetting, error)
+	RoleRequiresTwoFactor(role Role) (bool, error)
+	SetRoleRequiresTwoFactor(role Role, required bool) error
+	CreateOAuthState(state *OAuthState) error
+	ConsumeOAuthState(stateHash, provider string) (*OAuthState, error)
+	GetUserByIdentity(provider, subject string) (*User, error)
+	LinkIdentity(identity ExternalIdentity, verifyAccount bool) error
+	CreateOAuthUser(u User, identity ExternalIdentity) (*User, error)
+	GetIdentities(userId int64) (*[]ExternalIdentity, error)
+	DeleteIdentity(userId int64, id uint) error
 	SendVerificationCode(email, otp, username string) error
+	SendPasswordResetLink(email, link, username string, expiresIn time.Duration) error
+	CreatePasswordResetToken(userId int64, tokenHash string, expiresAt time.Time) error
+	ResetPassword(tokenHash, password string) error
+	SendEmailChangeConfirmation(email, link, username string, expiresIn time.Duration) error
+	SendEmailChangeNotice(email, undoLink, username, newEmail string) error
+	CreateEmailChange(change *EmailChange) error
+	ConfirmEmailChange(tokenHash string) error
+	UndoEmailChange(tokenHash string) error
+	CreateRefreshToken(userId int64, familyId, tokenHash string, expiresAt time.Time) error
+	GetRefreshToken(tokenHash string) (*RefreshToken, error)
+	RotateRefreshToken(tokenHash, newTokenHash string, expiresAt time.Time) (*RefreshToken, error)
+	RevokeRefreshTokenFamily(familyId string) error
+	RevokeAllRefreshTokens(userId int64) error
+	CreateSession(session *Session) error
+	GetSessions(userId int64) (*[]Session, error)
+	GetActiveSession(userId int64, familyId string) (*Session, error)
+	TouchSession(id uint) error
+	RevokeSession(userId int64, id uint) error
+	GetSession(userId int64, id uint) (*Session, error)
+	ReauthenticateSession(userId int64, id uint) error
+	SearchUsers(opts UserSearchOptions) (*UserPage, error)
+	SetUserSuspended(id int64, suspended bool, reason string) error
+	RequireReverification(id int64) error
+	SetUserRole(id int64, role Role) error
+	CreateAuditLog(entry AuditLog) error
+	GetAuditLogs(targetUserId int64, limit, offset int) (*[]AuditLog, error)
 }
 
 type User struct {
 	gorm.Model
-	FirstName     string    `json:"first_name" validate:"required,min=3,max=30"`
-	LastName      string    `json:"last_name" validate:"required,max=30"`
-	Email         string    `json:"email" gorm:"uniqueIndex" validate:"required,email"`
-	Password      string    `json:"password" validate:"required"`
-	AvatarUrl     string    `json:"avatar_url" validate:"required"`
-	Blogs         []Blog    `gorm:"foreignKey:UserId"` // One-to-many relationship
-	Otp           string    `json:"-" validate:"-"`
-	OtpExpiration time.Time `json:"-" validate:"-"`
-	Verified      bool      `json:"-" validate:"-" gorm:"default:false"`
+	FirstName     string            `json:"first_name" validate:"required,min=3,max=30"`
+	LastName      string            `json:"last_name" validate:"required,max=30"`
+	Email         string            `json:"email" gorm:"uniqueIndex" validate:"required,email"`
+	Password      string            `json:"-" validate:"required"`
+	AvatarUrl     string            `json:"avatar_url" validate:"required"`
+	Bio           string            `json:"bio" validate:"max=500"`
+	Website       string            `json:"website" validate:"omitempty,url"`
+	SocialLinks   map[string]string `json:"social_links" gorm:"serializer:json" validate:"-"` // e.g. {"github": "https://github.com/..."}
+	Blogs         []Blog            `json:"blogs,omitempty" gorm:"foreignKey:UserId"`         // One-to-many relationship
+	Otp           string            `json:"-" validate:"-"`
+	OtpExpiration time.Time         `json:"-" validate:"-"`
+	Verified      bool              `json:"verified" validate:"-" gorm:"default:false"`
+	Role          Role              `json:"role" validate:"-" gorm:"default:author"`
+	// suspended users can't log in, and their sessions are rejected
+	SuspendedAt   *time.Time `json:"suspended_at" validate:"-"`
+	SuspendReason string     `json:"suspend_reason,omitempty" validate:"-"`
+	// bumped to log the user out everywhere, tokens carrying an older version are rejected
+	TokenVersion int64 `json:"-" validate:"-" gorm:"default:0"`
+	// set while the account waits out the grace period before it is deleted
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty" gorm:"index" validate:"-"`
+	DeletionContent     string     `json:"deletion_content,omitempty" validate:"-"`
+	// the TOTP secret is set when enrollment starts, and only used for logins once it is confirmed
+	TOTPSecret  string `json:"-" validate:"-"`
+	TOTPEnabled bool   `json:"two_factor_enabled" validate:"-" gorm:"default:false"`
+	// time step of the last accepted code, so a code can't be used twice
+	TOTPLastStep int64 `json:"-" validate:"-" gorm:"default:0"`
+}
+
+// Can reports whether the user's role has the permission
+func (u User) Can(p Permission) bool {
+	return u.Role.Can(p)
+}
+
+// PublicProfile is what anyone can see of a user
+type PublicProfile struct {
+	ID          uint              `json:"id"`
+	FirstName   string            `json:"first_name"`
+	LastName    string            `json:"last_name"`
+	AvatarUrl   string            `json:"avatar_url"`
+	Bio         string            `json:"bio"`
+	Website     string            `json:"website"`
+	SocialLinks map[string]string `json:"social_links"`
+	Role        Role              `json:"role"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+func (u User) PublicProfile() PublicProfile {
+	return PublicProfile{
+		ID:          u.ID,
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		AvatarUrl:   u.AvatarUrl,
+		Bio:         u.Bio,
+		Website:     u.Website,
+		SocialLinks: u.SocialLinks,
+		Role:        u.Role,
+		CreatedAt:   u.CreatedAt,
+	}
+}
+
+// UpdateProfilePayload is the body of PATCH /me. only the fields that are sent are changed
+type UpdateProfilePayload struct {
+	FirstName   *string           `json:"first_name" validate:"omitempty,min=3,max=30"`
+	LastName    *string           `json:"last_name" validate:"omitempty,max=30"`
+	AvatarUrl   *string           `json:"avatar_url" validate:"omitempty,url"`
+	Bio         *string           `json:"bio" validate:"omitempty,max=500"`
+	Website     *string           `json:"website" validate:"omitempty,eq=|url"` // "" removes it
+	SocialLinks map[string]string `json:"social_links" validate:"omitempty,max=10,dive,keys,min=1,max=30,endkeys,url"`
+}
+
+// PasswordResetToken is a single use password reset link. only the hash of the token is stored
+type PasswordResetToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"index"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+/*
+RefreshToken renews the access token of a login. every refresh uses the token up and issues a new
+one in the same family, so presenting a used token means it was stolen and the family is revoked
+*/
+type RefreshToken struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	FamilyID  string `gorm:"index"` // shared by every token descending from one login
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// Session is one login of a user, on one device. it lives as long as its refresh token family
+type Session struct {
+	ID        uint   `json:"id" gorm:"primaryKey"`
+	UserID    uint   `json:"-" gorm:"index"`
+	FamilyID  string `json:"-" gorm:"uniqueIndex"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	Current   bool   `json:"current" gorm:"-"` // the session of the request listing the sessions
+	// set when an admin started the session to act as the user
+	ImpersonatorID *uint      `json:"impersonator_id,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastSeenAt     time.Time  `json:"last_seen_at"`
+	RevokedAt      *time.Time `json:"-"`
+	// the last time the user logged in again through a provider to confirm a sensitive change,
+	// which is how accounts without a password confirm them
+	ReauthenticatedAt *time.Time `json:"-"`
+}
+
+// UserSearchOptions filters the user listing of the admin api
+type UserSearchOptions struct {
+	Query     string // matches the name or the email
+	Role      Role
+	Suspended *bool
+	Limit     int
+	Offset    int
+}
+
+type UserPage struct {
+	Data  []User `json:"data"`
+	Total int64  `json:"total"`
+}
+
+// AuditLog records an action an admin took on a user account
+type AuditLog struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	ActorID      uint      `json:"actor_id" gorm:"index"`
+	Action       string    `json:"action"`
+	TargetUserID uint      `json:"target_user_id" gorm:"index"`
+	Details      string    `json:"details,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const (
+	AuditActionSuspend     = "suspend"
+	AuditActionUnsuspend   = "unsuspend"
+	AuditActionReverify    = "require_reverification"
+	AuditActionChangeRole  = "change_role"
+	AuditActionImpersonate = "impersonate"
+	AuditActionRole2FA     = "require_two_factor" // on a role rather than a user
+)
+
+// RoleSetting holds the admin controlled settings of a role. roles without a row use the defaults
+type RoleSetting struct {
+	Role             Role      `json:"role" gorm:"primaryKey;type:varchar(20)"`
+	RequireTwoFactor bool      `json:"require_two_factor" gorm:"default:false"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// RecoveryCode is a single use code that stands in for a TOTP code, e.g. when the phone is lost
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	CodeHash  string `gorm:"uniqueIndex"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// wrong codes a login challenge takes before it stops working
+const MaxLoginChallengeAttempts = 5
+
+/*
+LoginChallenge is the second step of a login with two-factor authentication. the password was
+right, and the token lets the client send a code (or enroll, when the user's role requires 2FA)
+*/
+type LoginChallenge struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	Attempts  int    `gorm:"default:0"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TwoFactorSetup is what an authenticator app needs to add the account
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+	QRCode string `json:"qr_code"` // the uri as a png, in a data url
+}
+
+// TwoFactorCodePayload carries a code from the authenticator app, or one of the recovery codes
+type TwoFactorCodePayload struct {
+	Code         string `json:"code" validate:"required_without=RecoveryCode,omitempty,numeric,len=6"`
+	RecoveryCode string `json:"recovery_code" validate:"required_without=Code"`
+}
+
+type DisableTwoFactorPayload struct {
+	Password string `json:"password"` // accounts without a password only need the second factor
+	TwoFactorCodePayload
+}
+
+type TwoFactorLoginPayload struct {
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	TwoFactorCodePayload
+}
+
+/*
+EmailChange is a pending or finished change of a user's email. the new address confirms it,
+and the old address can undo it for a while, even after it was confirmed
+*/
+type EmailChange struct {
+	ID               uint `gorm:"primaryKey"`
+	UserID           uint `gorm:"index"`
+	OldEmail         string
+	NewEmail         string
+	ConfirmTokenHash string    `gorm:"uniqueIndex"`
+	UndoTokenHash    string    `gorm:"uniqueIndex"`
+	ExpiresAt        time.Time // until when the new address can confirm
+	UndoExpiresAt    time.Time // until when the old address can undo
+	ConfirmedAt      *time.Time
+	UndoneAt         *time.Time
+	CreatedAt        time.Time
+}
+
+type ChangeEmailPayload struct {
+	NewEmail string `json:"new_email" validate:"required,email"`
+	Password string `json:"password"` // accounts without a password reauthenticate instead
+}
+
+// TokenPayload is the body of the endpoints opened through an emailed link
+type TokenPayload struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// ExternalIdentity is an account at a social login provider, linked to a user. a user can have several
+type ExternalIdentity struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	UserID    uint      `json:"-" gorm:"index"`
+	Provider  string    `json:"provider" gorm:"type:varchar(50);uniqueIndex:idx_identity_provider_subject"`
+	Subject   string    `json:"-" gorm:"uniqueIndex:idx_identity_provider_subject"` // the id of the account at the provider
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+/*
+OAuthState is a social login in progress, between the redirect to the provider and its callback.
+it is looked up by the state parameter and used once
+*/
+type OAuthState struct {
+	ID           uint   `gorm:"primaryKey"`
+	StateHash    string `gorm:"uniqueIndex"`
+	Provider     string
+	Nonce        string
+	CodeVerifier string // the PKCE verifier
+	LinkUserID   *uint  // set when a logged in user links a new identity
+	// set when a logged in user logs in again to confirm a sensitive change
+	ReauthSessionID *uint
+	ExpiresAt       time.Time
+	CreatedAt       time.Time
+}
+
+// what happens to the blogs and comments of a deleted account
+const (
+	DeletionRemove    = "remove"    // blogs are deleted and comments left as empty placeholders
+	DeletionAnonymise = "anonymise" // blogs and comments stay, credited to an anonymous deleted user
+)
+
+type DeleteAccountPayload struct {
+	Password string `json:"password"` // accounts without a password reauthenticate instead
+	Content  string `json:"content" validate:"required,oneof=remove anonymise"`
+}
+
+// UserExport is everything stored about a user, as handed out by the data export
+type UserExport struct {
+	User         User               `json:"profile"`
+	Sessions     []Session          `json:"sessions"`
+	Blogs        []Blog             `json:"blogs"` // including the ones in the trash
+	Tags         []string           `json:"tags"`  // the tags used on the user's blogs
+	Comments     []Comment          `json:"comments"`
+	Reactions    []Reaction         `json:"reactions"`
+	Bookmarks    []Bookmark         `json:"bookmarks"`
+	ReadingLists []ReadingList      `json:"reading_lists"`
+	Identities   []ExternalIdentity `json:"identities"`
+}
+
+type ForgotPasswordPayload struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordPayload struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8"`
 }
 
 type RegisterUserPayload struct {
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/go-playground/validator/v10"
@@ -17,6 +19,33 @@ func ParseJSON(r *http.Request, v any) error {
 	return json.NewDecoder(r.Body).Decode(v)
 }
 
+/*
+ParseJSONFields decodes the body into v like ParseJSON, and also returns the raw top level fields.
+PATCH handlers use it to tell a field sent as null apart from a field that was left out
+*/
+func ParseJSONFields(r *http.Request, v any) (map[string]json.RawMessage, error) {
+	if r.Body == nil {
+		return nil, fmt.Errorf("missing request body")
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// IsJSONNull reports whether a raw field from ParseJSONFields was sent as null
+func IsJSONNull(raw json.RawMessage) bool {
+	return string(bytes.TrimSpace(raw)) == "null"
+}
+
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(status)